@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//  Per-app output logs.
+//
+//  The stdout and stderr of every activation script and supervised process
+//  are written to logs/<UID>.out and logs/<UID>.err in tgo's directory.
+//  When a file grows past MaxSize it is renamed to <file>.1, the previous
+//  <file>.1 becomes <file>.2, and so on, keeping Keep old files. The last
+//  few lines an app wrote to stderr are included in the reasons sent to
+//  uhura when the app fails.
+
+// logDescr describes where app output is written. A value of 0 or "" means
+// the default is used.
+type logDescr struct {
+	Dir     string // directory for the log files, default "logs"
+	MaxSize int64  // bytes a file can grow to before it is rotated, default 10MB
+	Keep    int    // number of rotated files to keep, default 3
+}
+
+// defaultLogs are the log settings used for any value not supplied in the
+// environment descriptor
+var defaultLogs = logDescr{
+	Dir:     "logs",
+	MaxSize: 10 * 1024 * 1024,
+	Keep:    3,
+}
+
+// tailLines is the number of lines of stderr included in error reports
+const tailLines = 5
+
+// logSettings returns the log settings from the environment descriptor
+// with defaults filled in
+func logSettings() logDescr {
+	ls := defaultLogs
+	if envMap.Logs != nil {
+		if envMap.Logs.Dir != "" {
+			ls.Dir = envMap.Logs.Dir
+		}
+		if envMap.Logs.MaxSize > 0 {
+			ls.MaxSize = envMap.Logs.MaxSize
+		}
+		if envMap.Logs.Keep > 0 {
+			ls.Keep = envMap.Logs.Keep
+		}
+	}
+	return ls
+}
+
+// rotatingFile is an io.Writer that appends to a file and rotates it when
+// it reaches its size limit. Write errors are logged once and otherwise
+// ignored, so a full disk never causes an app to fail.
+type rotatingFile struct {
+	mu     sync.Mutex
+	path   string
+	max    int64
+	keep   int
+	f      *os.File
+	size   int64
+	failed bool
+}
+
+func (r *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, fi.Size()
+	return nil
+}
+
+// rotate closes the file and shifts it and the older files down by one
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	r.f = nil
+	os.Remove(fmt.Sprintf("%s.%d", r.path, r.keep))
+	for n := r.keep - 1; n >= 1; n-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, n), fmt.Sprintf("%s.%d", r.path, n+1))
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := func() error {
+		if r.f == nil {
+			if err := r.open(); err != nil {
+				return err
+			}
+		}
+		if r.size > 0 && r.size+int64(len(p)) > r.max {
+			if err := r.rotate(); err != nil {
+				return err
+			}
+		}
+		n, err := r.f.Write(p)
+		r.size += int64(n)
+		return err
+	}()
+	if err != nil && !r.failed {
+		ulog("could not write to %s: %v\n", r.path, err)
+		r.failed = true
+	}
+	return len(p), nil
+}
+
+// Close closes the file. A later Write opens it again.
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+// tailBuffer keeps the last lines written to it
+type tailBuffer struct {
+	mu    sync.Mutex
+	lines []string
+	part  string // the last line, if it did not end in a newline
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := strings.Split(t.part+string(p), "\n")
+	t.part = s[len(s)-1]
+	t.lines = append(t.lines, s[:len(s)-1]...)
+	if len(t.lines) > tailLines {
+		t.lines = t.lines[len(t.lines)-tailLines:]
+	}
+	return len(p), nil
+}
+
+// String returns the last lines written, joined by " | "
+func (t *tailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	lines := t.lines
+	if t.part != "" {
+		lines = append(append([]string{}, lines...), t.part)
+	}
+	if len(lines) > tailLines {
+		lines = lines[len(lines)-tailLines:]
+	}
+	return strings.Join(lines, " | ")
+}
+
+func (t *tailBuffer) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lines, t.part = nil, ""
+}
+
+// appOutput is where an app's output goes
+type appOutput struct {
+	out  *rotatingFile
+	err  *rotatingFile
+	tail *tailBuffer // the end of the most recent stderr output
+}
+
+// appOutputs holds the output destinations, indexed by app UID
+var appOutputs = struct {
+	sync.Mutex
+	m map[string]*appOutput
+}{m: make(map[string]*appOutput)}
+
+// getAppOutput returns the output destinations for the app, creating them
+// the first time they are needed
+func getAppOutput(a *appDescr) *appOutput {
+	appOutputs.Lock()
+	defer appOutputs.Unlock()
+	if o, ok := appOutputs.m[a.UID]; ok {
+		return o
+	}
+	ls := logSettings()
+	base := filepath.Join(ls.Dir, a.UID)
+	o := &appOutput{
+		out:  &rotatingFile{path: base + ".out", max: ls.MaxSize, keep: ls.Keep},
+		err:  &rotatingFile{path: base + ".err", max: ls.MaxSize, keep: ls.Keep},
+		tail: &tailBuffer{},
+	}
+	appOutputs.m[a.UID] = o
+	return o
+}
+
+// begin marks the start of a new command in the app's logs, and starts a
+// new stderr tail. It returns the writers for the command's stdout and
+// stderr.
+func (o *appOutput) begin(what string) (io.Writer, io.Writer) {
+	hdr := fmt.Sprintf("=== %s %s\n", time.Now().Format(time.RFC3339), what)
+	o.out.Write([]byte(hdr))
+	o.err.Write([]byte(hdr))
+	o.tail.reset()
+	return o.out, io.MultiWriter(o.err, o.tail)
+}
+
+// closeAppOutput closes the app's log files, if they are open. The stderr
+// tail is kept for error reports.
+func closeAppOutput(a *appDescr) {
+	appOutputs.Lock()
+	o, ok := appOutputs.m[a.UID]
+	appOutputs.Unlock()
+	if ok {
+		o.out.Close()
+		o.err.Close()
+	}
+}
+
+// stderrTail returns the last lines the app wrote to stderr, in a form that
+// can be appended to a reason sent to uhura. It is "" if there are none.
+func stderrTail(a *appDescr) string {
+	appOutputs.Lock()
+	o, ok := appOutputs.m[a.UID]
+	appOutputs.Unlock()
+	if !ok {
+		return ""
+	}
+	if s := o.tail.String(); s != "" {
+		return "; stderr: " + s
+	}
+	return ""
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.out")
+	r := &rotatingFile{path: path, max: 10, keep: 2}
+	for n := 1; n <= 4; n++ {
+		fmt.Fprintf(r, "line %d\n", n) // 7 bytes each, so every write rotates
+	}
+	if err := r.Close(); err != nil || r.f != nil {
+		t.Fatalf("expected the file to be closed, got %v", err)
+	}
+	for suffix, want := range map[string]string{"": "line 4\n", ".1": "line 3\n", ".2": "line 2\n"} {
+		b, err := ioutil.ReadFile(path + suffix)
+		if err != nil || string(b) != want {
+			t.Errorf("%s%s: expected %q, got %q, %v", path, suffix, want, b, err)
+		}
+	}
+	if _, err := ioutil.ReadFile(path + ".3"); err == nil {
+		t.Errorf("expected only 2 rotated files to be kept")
+	}
+
+	// writing after Close opens the file again, and still rotates it
+	fmt.Fprint(r, "more\n")
+	r.Close()
+	b, _ := ioutil.ReadFile(path)
+	b1, _ := ioutil.ReadFile(path + ".1")
+	if string(b) != "more\n" || string(b1) != "line 4\n" {
+		t.Errorf("unexpected files after reopening: %q, %q", b, b1)
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	var tb tailBuffer
+	fmt.Fprint(&tb, "1\n2\n3\n4")
+	fmt.Fprint(&tb, "5\n6\n7")
+	if s := tb.String(); s != "2 | 3 | 45 | 6 | 7" {
+		t.Errorf("expected the last lines, got %q", s)
+	}
+}
+
+func TestActivateOutput(t *testing.T) {
+	defer supervisedEnv(scriptApp(t, "noisy", "echo starting >&2\necho ok\necho not today >&2\nexit 2\n"))()
+
+	_, err := activateCmd(context.Background(), 1, "start")
+	se, ok := err.(*stateError)
+	if !ok || !strings.HasSuffix(se.Reason, "; stderr: starting | not today") {
+		t.Fatalf("expected the stderr tail in the reason, got %v", err)
+	}
+	dir := envMap.Logs.Dir
+	out, _ := ioutil.ReadFile(filepath.Join(dir, "noisy.out"))
+	errs, _ := ioutil.ReadFile(filepath.Join(dir, "noisy.err"))
+	if !strings.HasSuffix(string(out), "activate.sh start\nok\n") {
+		t.Errorf("unexpected stdout log: %q", out)
+	}
+	if !strings.HasSuffix(string(errs), "activate.sh start\nstarting\nnot today\n") {
+		t.Errorf("unexpected stderr log: %q", errs)
+	}
+
+	stopApp(1, time.Second)
+	o := getAppOutput(&envMap.Instances[0].Apps[1])
+	if o.out.f != nil || o.err.f != nil {
+		t.Errorf("expected the logs to be closed once the app stopped")
+	}
+}
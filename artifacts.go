@@ -0,0 +1,278 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+//  Artifacts.
+//
+//  An app can list files to be kept after the run as globs relative to
+//  its directory:
+//
+//      "Artifacts": ["logs/*.log", "core*", "results/*"]
+//
+//  When the tests are done, and when tgo fails, the matching files of
+//  every app, and the merged JUnit report, are bundled into a tar.gz with
+//  a manifest.json and uploaded to uhura at <UhuraURL>artifacts/. Each
+//  file is stored as <UID>/<path>. ArtifactURL in the environment
+//  descriptor overrides where the bundle goes; a file:// URL names a
+//  local directory to copy it to, which is handy without an uhura.
+//
+//  Nothing is bundled if no app lists any artifacts. A failed upload is
+//  logged but does not fail the run.
+
+// artifactFile describes a file in an artifact bundle
+type artifactFile struct {
+	App    string // UID of the app the file belongs to
+	Path   string // path in the bundle
+	Size   int64
+	SHA256 string
+}
+
+// artifactManifest is the manifest.json in an artifact bundle
+type artifactManifest struct {
+	EnvName  string
+	InstName string
+	Created  string
+	Trigger  string // DONE, or BLOCKED and the reason
+	Files    []artifactFile
+}
+
+// artifactPaths returns the files matching the app's artifact globs
+func artifactPaths(a *appDescr) []string {
+	seen := map[string]bool{}
+	var paths []string
+	for _, g := range a.Artifacts {
+		matches, err := filepath.Glob(filepath.Join(appDir(a), g))
+		if err != nil {
+			ulog("bad artifact pattern %q for %s: %v\n", g, a.UID, err)
+			continue
+		}
+		for _, m := range matches {
+			if fi, err := os.Stat(m); err == nil && fi.Mode().IsRegular() && !seen[m] {
+				seen[m] = true
+				paths = append(paths, m)
+			}
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// addToTar writes the file at path to tw as name, and returns its entry
+// for the manifest. Logs may grow, shrink or rotate while they are read,
+// so the file is first copied to a snapshot in dir and the snapshot is
+// what goes in the bundle.
+func addToTar(tw *tar.Writer, dir, uid, path, name string) (artifactFile, error) {
+	af := artifactFile{App: uid, Path: name}
+	f, err := os.Open(path)
+	if err != nil {
+		return af, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return af, err
+	}
+	snap, err := ioutil.TempFile(dir, "artifact-*")
+	if err != nil {
+		return af, err
+	}
+	defer os.Remove(snap.Name())
+	defer snap.Close()
+	size, err := io.Copy(snap, f)
+	if err != nil {
+		return af, err
+	}
+	if _, err := snap.Seek(0, io.SeekStart); err != nil {
+		return af, err
+	}
+
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: size, ModTime: fi.ModTime()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return af, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tw, h), io.LimitReader(snap, size))
+	if err != nil {
+		return af, err
+	}
+	af.Size, af.SHA256 = n, hex.EncodeToString(h.Sum(nil))
+	return af, nil
+}
+
+// bundleArtifacts writes the artifacts of every app to a tar.gz in dir. It
+// returns the path of the bundle, or "" if there was nothing to bundle.
+func bundleArtifacts(dir, trigger string) (string, error) {
+	type entry struct{ uid, path, name string }
+	var entries []entry
+	for i := range envMap.Instances[envMap.ThisInst].Apps {
+		a := &envMap.Instances[envMap.ThisInst].Apps[i]
+		for _, p := range artifactPaths(a) {
+			rel, err := filepath.Rel(appDir(a), p)
+			if err != nil {
+				rel = filepath.Base(p)
+			}
+			entries = append(entries, entry{a.UID, p, filepath.ToSlash(filepath.Join(a.UID, rel))})
+		}
+	}
+	if len(entries) == 0 {
+		return "", nil
+	}
+	report := envMap.Report
+	if report == "" {
+		report = defaultReport
+	}
+	if _, err := os.Stat(report); err == nil {
+		tgo := envMap.Instances[envMap.ThisInst].Apps[envMap.ThisApp].UID
+		entries = append(entries, entry{tgo, report, tgo + "/" + filepath.Base(report)})
+	}
+
+	f, err := ioutil.TempFile(dir, "artifacts-*.tar.gz")
+	if err != nil {
+		return "", err
+	}
+	fail := func(err error) (string, error) { // don't leave a partial bundle behind
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	m := artifactManifest{
+		EnvName:  envMap.EnvName,
+		InstName: envMap.Instances[envMap.ThisInst].InstName,
+		Created:  time.Now().Format(time.RFC3339),
+		Trigger:  trigger,
+	}
+	for _, e := range entries {
+		af, err := addToTar(tw, dir, e.uid, e.path, e.name)
+		if err != nil {
+			ulog("could not add artifact %s: %v\n", e.path, err)
+			continue
+		}
+		m.Files = append(m.Files, af)
+	}
+	b, _ := json.MarshalIndent(&m, "", "  ")
+	if err := tw.WriteHeader(&tar.Header{Name: "manifest.json", Mode: 0644, Size: int64(len(b)), ModTime: time.Now()}); err != nil {
+		return fail(err)
+	}
+	if _, err := tw.Write(b); err != nil {
+		return fail(err)
+	}
+	if err := tw.Close(); err != nil {
+		return fail(err)
+	}
+	if err := gz.Close(); err != nil {
+		return fail(err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// artifactURL returns where artifact bundles are uploaded
+func artifactURL() string {
+	if envMap.ArtifactURL != "" {
+		return envMap.ArtifactURL
+	}
+	return envMap.UhuraURL + "artifacts/"
+}
+
+// uploadBundle sends the bundle at path to the artifact URL
+func uploadBundle(path string) error {
+	dest := artifactURL()
+	if strings.HasPrefix(dest, "file://") {
+		dir := strings.TrimPrefix(dest, "file://")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		name := fmt.Sprintf("%s-%s.tar.gz", envMap.Instances[envMap.ThisInst].InstName, time.Now().Format("20060102-150405"))
+		out, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(out, f)
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	q := url.Values{}
+	q.Set("InstName", envMap.Instances[envMap.ThisInst].InstName)
+	q.Set("UID", envMap.Instances[envMap.ThisInst].Apps[envMap.ThisApp].UID)
+	req, err := http.NewRequest("POST", dest+"?"+q.Encode(), f)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/gzip")
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := signRequestSum(req, h.Sum(nil)); err != nil {
+		return err
+	}
+	client, err := uhuraClient(10 * time.Minute)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("upload to %s: %s", dest, resp.Status)
+	}
+	return nil
+}
+
+// uploadArtifacts bundles the artifacts of every app and uploads them. The
+// trigger says why, and is recorded in the manifest. Errors are logged.
+func uploadArtifacts(trigger string) {
+	if envMap.ArtifactURL == "" && (!uhuraOverHTTP() || !uhuraWants(featArtifacts)) {
+		return // there is no uhura to take them, or it has said it doesn't
+	}
+	path, err := bundleArtifacts(".", trigger)
+	if err != nil {
+		ulog("could not bundle artifacts: %v\n", err)
+	}
+	if path == "" {
+		return
+	}
+	defer os.Remove(path)
+	if err := uploadBundle(path); err != nil {
+		ulog("could not upload artifacts: %v\n", err)
+		return
+	}
+	ulog("artifacts uploaded to %s\n", artifactURL())
+}
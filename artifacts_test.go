@@ -0,0 +1,142 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readBundle returns the contents of the files in a tar.gz
+func readBundle(t *testing.T, r io.Reader) map[string]string {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(tr)
+		files[hdr.Name] = string(b)
+	}
+}
+
+func TestUploadArtifacts(t *testing.T) {
+	app := scriptApp(t, "svc", "echo ok\n")
+	app.Artifacts = []string{"*.log", "sub/*", "nothing*"}
+	defer supervisedEnv(app, appDescr{UID: "other", Name: "other"})()
+	envMap.Report = filepath.Join(t.TempDir(), "none.xml")
+	dir := appDir(&envMap.Instances[0].Apps[1])
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	for name, content := range map[string]string{"svc.log": "started", "sub/core": "dump", "keep.txt": "not an artifact"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	}
+
+	var body []byte
+	var query string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer ts.Close()
+	envMap.UhuraURL = ts.URL + "/"
+
+	uploadArtifacts("DONE")
+	if query != "InstName=SuperviseTest&UID=tgo0" {
+		t.Errorf("unexpected upload query %q", query)
+	}
+	files := readBundle(t, bytes.NewReader(body))
+	if files["svc/svc.log"] != "started" || files["svc/sub/core"] != "dump" || len(files) != 3 {
+		t.Fatalf("unexpected bundle contents: %v", files)
+	}
+	var m artifactManifest
+	if err := json.Unmarshal([]byte(files["manifest.json"]), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Trigger != "DONE" || len(m.Files) != 2 || m.Files[1].Path != "svc/svc.log" || m.Files[1].Size != 7 {
+		t.Errorf("unexpected manifest: %+v", m)
+	}
+
+	// a file:// URL is a stub that keeps the bundle locally
+	stub := t.TempDir()
+	envMap.ArtifactURL = "file://" + stub
+	uploadArtifacts("BLOCKED: test")
+	bundles, _ := filepath.Glob(filepath.Join(stub, "SuperviseTest-*.tar.gz"))
+	if len(bundles) != 1 {
+		t.Fatalf("expected a bundle in %s, got %v", stub, bundles)
+	}
+	f, _ := os.Open(bundles[0])
+	defer f.Close()
+	if files := readBundle(t, f); !strings.Contains(files["manifest.json"], "BLOCKED: test") {
+		t.Errorf("expected the trigger in the manifest, got %s", files["manifest.json"])
+	}
+	if left, _ := filepath.Glob("artifacts-*.tar.gz"); len(left) != 0 {
+		t.Errorf("temporary bundles were left behind: %v", left)
+	}
+}
+
+func TestBundleGrowingLog(t *testing.T) {
+	app := scriptApp(t, "svc", "echo ok\n")
+	app.Artifacts = []string{"*.log"}
+	defer supervisedEnv(app)()
+	envMap.Report = filepath.Join(t.TempDir(), "none.xml")
+	log := filepath.Join(appDir(&envMap.Instances[0].Apps[1]), "svc.log")
+	ioutil.WriteFile(log, []byte("started\n"), 0644)
+
+	// the app keeps logging while the bundle is made
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f, _ := os.OpenFile(log, os.O_WRONLY|os.O_APPEND, 0644)
+		defer f.Close()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				f.WriteString(strings.Repeat("x", 1000) + "\n")
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+	defer func() { close(stop); <-done }()
+
+	dir := t.TempDir()
+	for i := 0; i < 5; i++ {
+		path, err := bundleArtifacts(dir, "DONE")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, _ := os.Open(path)
+		files := readBundle(t, f)
+		f.Close()
+		var m artifactManifest
+		if err := json.Unmarshal([]byte(files["manifest.json"]), &m); err != nil {
+			t.Fatal(err)
+		}
+		if len(m.Files) != 1 || m.Files[0].Size != int64(len(files["svc/svc.log"])) {
+			t.Fatalf("manifest does not match the bundle: %+v", m)
+		}
+		os.Remove(path)
+	}
+	if left, _ := filepath.Glob(filepath.Join(dir, "artifact-*")); len(left) != 0 {
+		t.Errorf("snapshots were left behind: %v", left)
+	}
+}
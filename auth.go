@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//  Authentication.
+//
+//  When the environment descriptor has an Auth section, uhura and tgo
+//  share a secret and sign every request they send each other with it:
+//
+//      X-Tgo-Timestamp   the time the request was signed, in Unix seconds
+//      X-Tgo-Nonce       a random value used once
+//      X-Tgo-Signature   hex HMAC-SHA256 of the secret over
+//                        method \n path?query \n timestamp \n nonce \n hex sha256(body)
+//
+//  tgo rejects commands that are unsigned, badly signed, signed more than
+//  MaxSkew seconds away from its own clock, or that reuse a nonce it has
+//  already seen. A rejected command gets HTTP 401 and a StatusReply with
+//  ReplyCode RespUnauthorized. tgo signs its status messages, heartbeats
+//  and artifact uploads the same way. Requests to the read-only status
+//  API and /metrics are not checked, see statusapi.go.
+//
+//  The secret is masked when the descriptor is written to tgo's log, but
+//  SecretFile keeps it out of the descriptor altogether.
+
+// the headers that carry a request's signature
+const (
+	hdrTimestamp = "X-Tgo-Timestamp"
+	hdrNonce     = "X-Tgo-Nonce"
+	hdrSignature = "X-Tgo-Signature"
+)
+
+// defaultMaxSkew is the default for authDescr.MaxSkew, in seconds
+const defaultMaxSkew = 300
+
+// maxSignedBody is the largest command body tgo will read to check its signature
+const maxSignedBody = 1 << 20
+
+// authDescr describes the secret shared with uhura
+type authDescr struct {
+	Secret     string // the secret itself
+	SecretFile string // or a file containing it, used if Secret is empty
+	MaxSkew    int    // seconds a request's timestamp may differ from our clock, default 300
+}
+
+// authSecret returns the shared secret, or nil if requests are not signed
+func authSecret() ([]byte, error) {
+	a := envMap.Auth
+	switch {
+	case a == nil:
+		return nil, nil
+	case a.Secret != "":
+		return []byte(a.Secret), nil
+	case a.SecretFile != "":
+		b, err := ioutil.ReadFile(a.SecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read secret: %v", err)
+		}
+		if s := bytes.TrimSpace(b); len(s) > 0 {
+			return s, nil
+		}
+		return nil, fmt.Errorf("secret file %s is empty", a.SecretFile)
+	}
+	return nil, fmt.Errorf("Auth has neither Secret nor SecretFile")
+}
+
+// maskSecret hides the shared secret in text that is about to be logged
+func maskSecret(text string) string {
+	if envMap.Auth == nil || envMap.Auth.Secret == "" {
+		return text
+	}
+	b, _ := json.Marshal(envMap.Auth.Secret) // as it appears in the descriptor
+	text = strings.Replace(text, string(b), `"********"`, -1)
+	return strings.Replace(text, envMap.Auth.Secret, "********", -1)
+}
+
+// maxSkew returns how far a request's timestamp may be from our clock
+func maxSkew() time.Duration {
+	if envMap.Auth != nil && envMap.Auth.MaxSkew > 0 {
+		return time.Duration(envMap.Auth.MaxSkew) * time.Second
+	}
+	return defaultMaxSkew * time.Second
+}
+
+// signature computes the signature of a request
+func signature(secret []byte, method, uri, ts, nonce string, sum []byte) string {
+	m := hmac.New(sha256.New, secret)
+	fmt.Fprintf(m, "%s\n%s\n%s\n%s\n%x", method, uri, ts, nonce, sum)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// signRequestSum signs req, whose body has the SHA-256 sum supplied. It does
+// nothing if requests are not signed.
+func signRequestSum(req *http.Request, sum []byte) error {
+	secret, err := authSecret()
+	if secret == nil {
+		return err
+	}
+	n := make([]byte, 16)
+	if _, err := rand.Read(n); err != nil {
+		return err
+	}
+	ts, nonce := strconv.FormatInt(time.Now().Unix(), 10), hex.EncodeToString(n)
+	req.Header.Set(hdrTimestamp, ts)
+	req.Header.Set(hdrNonce, nonce)
+	req.Header.Set(hdrSignature, signature(secret, req.Method, req.URL.RequestURI(), ts, nonce, sum))
+	return nil
+}
+
+// signRequest signs req, whose body is b
+func signRequest(req *http.Request, b []byte) error {
+	sum := sha256.Sum256(b)
+	return signRequestSum(req, sum[:])
+}
+
+// seenNonces holds the nonces of recently accepted requests and when they
+// were seen, so that a request cannot be replayed
+var seenNonces = struct {
+	sync.Mutex
+	m map[string]time.Time
+}{m: make(map[string]time.Time)}
+
+// useNonce records a nonce. It returns false if the nonce has already been
+// used. Nonces are forgotten once a request carrying them would be too old
+// to accept anyway.
+func useNonce(nonce string) bool {
+	seenNonces.Lock()
+	defer seenNonces.Unlock()
+	now := time.Now()
+	for n, t := range seenNonces.m {
+		if now.Sub(t) > 2*maxSkew() {
+			delete(seenNonces.m, n)
+		}
+	}
+	if _, ok := seenNonces.m[nonce]; ok {
+		return false
+	}
+	seenNonces.m[nonce] = now
+	return true
+}
+
+// verifyRequest checks the signature of r, whose body is b
+func verifyRequest(secret []byte, r *http.Request, b []byte) error {
+	ts, nonce, sig := r.Header.Get(hdrTimestamp), r.Header.Get(hdrNonce), r.Header.Get(hdrSignature)
+	if ts == "" || nonce == "" || sig == "" {
+		return fmt.Errorf("request is not signed")
+	}
+	secs, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad timestamp %q", ts)
+	}
+	if d := time.Since(time.Unix(secs, 0)); d > maxSkew() || d < -maxSkew() {
+		return fmt.Errorf("timestamp is %v away from our clock", d.Round(time.Second))
+	}
+	sum := sha256.Sum256(b)
+	want := signature(secret, r.Method, r.URL.RequestURI(), ts, nonce, sum[:])
+	if !hmac.Equal([]byte(strings.ToLower(sig)), []byte(want)) {
+		return fmt.Errorf("bad signature")
+	}
+	if !useNonce(nonce) {
+		return fmt.Errorf("nonce %s has already been used", nonce)
+	}
+	return nil
+}
+
+// authenticated wraps a handler so that it only sees signed requests, if
+// requests are signed
+func authenticated(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		secret, err := authSecret()
+		if secret == nil && err == nil {
+			h(w, r)
+			return
+		}
+		var b []byte
+		if err == nil {
+			b, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSignedBody))
+		}
+		if err == nil {
+			err = verifyRequest(secret, r, b)
+		}
+		if err != nil {
+			ulog("rejected request from %s: %v\n", r.RemoteAddr, err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			SendReply(w, RespUnauthorized, "UNAUTHORIZED: "+err.Error())
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(b))
+		h(w, r)
+	}
+}
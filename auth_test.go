@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// authEnv sets up an environment in which requests are signed with secret
+func authEnv(secret string) func() {
+	restore := supervisedEnv()
+	envMap.Auth = &authDescr{Secret: secret}
+	return restore
+}
+
+// command POSTs a command to tgo's command port, signed if sign is set
+func command(t *testing.T, ts *httptest.Server, cmd string, sign bool) (int, StatusReply) {
+	b, _ := json.Marshal(UCommand{Command: cmd})
+	req, _ := http.NewRequest("POST", ts.URL+"/", bytes.NewReader(b))
+	if sign {
+		if err := signRequest(req, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return do(t, req)
+}
+
+// do sends req and decodes the StatusReply
+func do(t *testing.T, req *http.Request) (int, StatusReply) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var r StatusReply
+	json.NewDecoder(resp.Body).Decode(&r)
+	return resp.StatusCode, r
+}
+
+func TestVerifyRequest(t *testing.T) {
+	defer authEnv("sesame")()
+	secret := []byte("sesame")
+	body := []byte(`{"Command":"STOP"}`)
+	signed := func() *http.Request {
+		req := httptest.NewRequest("POST", "/?x=1", nil)
+		if err := signRequest(req, body); err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+
+	req := signed()
+	if err := verifyRequest(secret, req, body); err != nil {
+		t.Errorf("signed request: %v", err)
+	}
+	if err := verifyRequest(secret, req, body); err == nil {
+		t.Errorf("replayed request was accepted")
+	}
+	if err := verifyRequest(secret, signed(), []byte(`{"Command":"ABORT"}`)); err == nil {
+		t.Errorf("request with a changed body was accepted")
+	}
+	if err := verifyRequest([]byte("open"), signed(), body); err == nil {
+		t.Errorf("request signed with another secret was accepted")
+	}
+	if err := verifyRequest(secret, httptest.NewRequest("POST", "/", nil), body); err == nil {
+		t.Errorf("unsigned request was accepted")
+	}
+
+	// a request signed long ago is rejected even if it has never been seen
+	old := signed()
+	ts := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	old.Header.Set(hdrTimestamp, ts)
+	sum := sha256Sum(body)
+	old.Header.Set(hdrSignature, signature(secret, "POST", "/?x=1", ts, old.Header.Get(hdrNonce), sum))
+	if err := verifyRequest(secret, old, body); err == nil {
+		t.Errorf("stale request was accepted")
+	}
+}
+
+func TestAuthenticatedCommands(t *testing.T) {
+	defer authEnv("sesame")()
+	Tgo.StopComm = make(chan int, 1)
+	ts := httptest.NewServer(newCommsMux())
+	defer ts.Close()
+
+	if code, r := command(t, ts, "STOP", false); code != http.StatusUnauthorized || r.ReplyCode != RespUnauthorized {
+		t.Errorf("unsigned command: expected 401 and RespUnauthorized, got %d %+v", code, r)
+	}
+	select {
+	case <-Tgo.StopComm:
+		t.Fatalf("unsigned STOP was acted on")
+	default:
+	}
+	if code, r := command(t, ts, "STOP", true); code != http.StatusOK || r.ReplyCode != RespOK {
+		t.Errorf("signed command: expected 200 and RespOK, got %d %+v", code, r)
+	}
+	if cmd := <-Tgo.StopComm; cmd != cmdSTOP {
+		t.Errorf("expected STOP, got %d", cmd)
+	}
+
+	// the status API and metrics can be read with plain curl
+	for _, path := range []string{"/v1/status", "/v1/apps/tgo0", "/v1/events", "/metrics"} {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("unsigned GET %s: expected 200, got %d", path, resp.StatusCode)
+		}
+	}
+
+	// but /v1/env does not give the secret away
+	envMap.Auth.SecretFile = "/etc/tgo/secret"
+	envMap.TLS = &tlsDescr{Cert: "tgo.pem", Key: "/etc/tgo/tgo-key.pem"}
+	resp, err := http.Get(ts.URL + "/v1/env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /v1/env: got %d", resp.StatusCode)
+	}
+	for _, s := range []string{"sesame", "/etc/tgo/secret", "tgo-key.pem"} {
+		if bytes.Contains(b, []byte(s)) {
+			t.Errorf("/v1/env shows %s", s)
+		}
+	}
+}
+
+func TestSignedStatus(t *testing.T) {
+	defer authEnv("")()
+	dir := t.TempDir()
+	file := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(file, []byte("sesame\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	envMap.Auth = &authDescr{SecretFile: file}
+	envMap.Retry = &retryDescr{Attempts: 3, Backoff: 1}
+
+	posts := 0
+	uhura := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		if err := verifyRequest([]byte("sesame"), r, b); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			SendReply(w, RespUnauthorized, err.Error())
+			return
+		}
+		posts++
+		SendReply(w, RespOK, "OK")
+	}))
+	defer uhura.Close()
+	envMap.UhuraURL = uhura.URL + "/"
+
+	var r StatusReply
+	if _, err := PostStatus(&StatusMsg{State: "INIT", UID: "tgo0"}, &r); err != nil || r.ReplyCode != RespOK {
+		t.Errorf("signed status: %v %+v", err, r)
+	}
+
+	// with a different secret uhura rejects the status, and it isn't retried
+	envMap.Auth = &authDescr{Secret: "guess"}
+	rc, err := PostStatus(&StatusMsg{State: "INIT", UID: "tgo0"}, &r)
+	if err == nil || rc != http.StatusUnauthorized || r.ReplyCode != RespUnauthorized {
+		t.Errorf("badly signed status: expected a rejection, got %d %v %+v", rc, err, r)
+	}
+	if pe, ok := err.(*PostError); !ok || pe.Attempts != 1 {
+		t.Errorf("expected one attempt, got %v", err)
+	}
+	if posts != 1 {
+		t.Errorf("expected uhura to accept 1 status, it accepted %d", posts)
+	}
+}
+
+// sha256Sum returns the SHA-256 sum of b
+func sha256Sum(b []byte) []byte {
+	s := sha256.Sum256(b)
+	return s[:]
+}
+
+func TestMaskSecret(t *testing.T) {
+	defer authEnv(`se"same`)()
+	descr := `{"Auth": {"Secret": "se\"same"}}`
+	if s := maskSecret(descr); strings.Contains(s, "same") {
+		t.Errorf("secret is not masked: %s", s)
+	}
+}
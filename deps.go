@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//  App dependencies.
+//
+//  An app can list the UIDs of other apps in its instance in DependsOn.
+//  tgo starts an app only after everything it depends on has been
+//  started and has replied "ok" to 'activate.sh ready'. Apps whose
+//  dependencies are satisfied are started at the same time. For example,
+//  a test rig with
+//
+//      db      (no dependencies)
+//      svc     "DependsOn": ["db"]
+//      svc_test "DependsOn": ["svc"]
+//
+//  starts db, waits for it to be ready, starts svc, waits for it to be
+//  ready, then starts svc_test. Apps are stopped in the reverse order.
+//
+//  A dependency on tgo itself is always satisfied. Dependencies on UIDs
+//  that are not in the instance, and cycles, are reported when the
+//  environment descriptor is loaded, before tgo says anything to uhura.
+
+// appDeps returns, for each app other than tgo, the indeces of the apps it
+// depends on. It returns an error if an app depends on an unknown UID.
+func appDeps() (map[int][]int, error) {
+	apps := envMap.Instances[envMap.ThisInst].Apps
+	index := map[string]int{}
+	for i := 0; i < len(apps); i++ {
+		index[apps[i].UID] = i
+	}
+	deps := map[int][]int{}
+	for i := 0; i < len(apps); i++ {
+		if i == envMap.ThisApp {
+			continue
+		}
+		deps[i] = []int{}
+		for _, uid := range apps[i].DependsOn {
+			j, ok := index[uid]
+			switch {
+			case !ok:
+				return nil, fmt.Errorf("app %s depends on %s, which is not in instance %s",
+					apps[i].UID, uid, envMap.Instances[envMap.ThisInst].InstName)
+			case j == i:
+				return nil, fmt.Errorf("app %s depends on itself", apps[i].UID)
+			case j == envMap.ThisApp:
+				continue // tgo is always up
+			}
+			deps[i] = append(deps[i], j)
+		}
+	}
+	return deps, nil
+}
+
+// appWaves returns the apps other than tgo grouped into waves. The apps in
+// each wave depend only on apps in earlier waves, so each wave can be
+// started once the one before it is ready. Within a wave the apps are in
+// array order. It returns an error naming the apps involved if there is a
+// dependency cycle.
+func appWaves() ([][]int, error) {
+	deps, err := appDeps()
+	if err != nil {
+		return nil, err
+	}
+	var waves [][]int
+	placed := map[int]bool{}
+	for len(placed) < len(deps) {
+		var wave []int
+		for i, d := range deps {
+			if placed[i] {
+				continue
+			}
+			ok := true
+			for _, j := range d {
+				ok = ok && placed[j]
+			}
+			if ok {
+				wave = append(wave, i)
+			}
+		}
+		if len(wave) == 0 {
+			var uids []string
+			for i := range deps {
+				if !placed[i] {
+					uids = append(uids, envMap.Instances[envMap.ThisInst].Apps[i].UID)
+				}
+			}
+			sort.Strings(uids)
+			return nil, fmt.Errorf("dependency cycle among apps: %s", strings.Join(uids, ", "))
+		}
+		sort.Ints(wave)
+		for _, i := range wave {
+			placed[i] = true
+		}
+		waves = append(waves, wave)
+	}
+	return waves, nil
+}
+
+// startApps runs 'activate.sh start' for every app other than tgo. An app
+// is started once all the apps it depends on are ready. Apps that can be
+// started at the same time are started concurrently, up to the worker
+// limit, but their replies are handled, and reported to uhura, in array
+// order. Starts that fail with a retryable error are tried again. Any
+// other failure is returned as an error, for the first app that depends on
+// the one that failed or, if there is none, for that app itself.
+func startApps(ctx context.Context) error {
+	if _, err := appWaves(); err != nil {
+		return err
+	}
+	deps, _ := appDeps()
+	apps := envMap.Instances[envMap.ThisInst].Apps
+	needed := map[int]bool{} // apps that other apps depend on
+	for _, d := range deps {
+		for _, j := range d {
+			needed[j] = true
+		}
+	}
+	failed := map[int]bool{}    // apps whose start failed
+	replies := map[int]string{} // and what they replied
+	ready := map[int]bool{}     // needed apps that have replied ok to ready
+	for {
+		progress := false
+		var batch, waiting []int
+		for i := 0; i < len(apps); i++ {
+			if _, ok := deps[i]; !ok || failed[i] {
+				continue
+			}
+			if appState(&apps[i]) >= STATEInitializing {
+				if needed[i] && !ready[i] {
+					waiting = append(waiting, i)
+				}
+				continue
+			}
+			ok := true
+			for _, j := range deps[i] {
+				ok = ok && ready[j]
+			}
+			if ok {
+				batch = append(batch, i)
+			}
+		}
+
+		res := activateApps(ctx, batch, "start")
+		for n, i := range batch {
+			if res[n].err != nil {
+				return res[n].err
+			}
+			started, err := checkReply(ctx, i, "start", "ok", STATEInitializing, "INIT", res[n].reply)
+			if err != nil {
+				return err
+			}
+			switch {
+			case started:
+				progress = true
+				if needed[i] {
+					waiting = append(waiting, i)
+				}
+			case parseReply(res[n].reply).errClass() == errRetryable:
+				ulog("%s: will retry the start command\n", apps[i].UID)
+			default:
+				failed[i] = true
+				replies[i] = strings.TrimRight(res[n].reply, "\n\r")
+			}
+		}
+
+		if err := blockedApp(deps, failed); err != nil {
+			return err
+		}
+		for i := 0; i < len(apps); i++ {
+			if failed[i] {
+				return appError(i, "%s did not start: %s%s", apps[i].UID, replies[i], stderrTail(&apps[i]))
+			}
+		}
+		pending := false
+		for i := range deps {
+			pending = pending || (!failed[i] && appState(&apps[i]) < STATEInitializing)
+		}
+		if !pending {
+			return nil
+		}
+
+		sort.Ints(waiting)
+		res = activateApps(ctx, waiting, "ready")
+		for n, i := range waiting {
+			if res[n].err != nil {
+				return res[n].err
+			}
+			rep := parseReply(res[n].reply)
+			if rep.Status == "ok" {
+				ulog("%s is ready, starting the apps that depend on it\n", apps[i].UID)
+				ready[i] = true
+				progress = true
+			}
+			if err := replyError(i, "ready", &rep); err != nil {
+				return err
+			}
+		}
+		if !progress {
+			if err := pause(ctx, pollInterval("INIT")); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// blockedApp returns an error for the first app that can never be started
+// because an app it depends on, directly or not, failed to start. deps must
+// not contain a cycle.
+func blockedApp(deps map[int][]int, failed map[int]bool) error {
+	apps := envMap.Instances[envMap.ThisInst].Apps
+	var blockedBy func(i int) int
+	blockedBy = func(i int) int {
+		for _, j := range deps[i] {
+			if failed[j] {
+				return j
+			}
+			if k := blockedBy(j); k >= 0 {
+				return k
+			}
+		}
+		return -1
+	}
+	for i := 0; i < len(apps); i++ {
+		if _, ok := deps[i]; !ok || failed[i] || appState(&apps[i]) >= STATEInitializing {
+			continue
+		}
+		if j := blockedBy(i); j >= 0 {
+			return appError(i, "cannot start %s: it depends on %s, which did not start", apps[i].UID, apps[j].UID)
+		}
+	}
+	return nil
+}
+
+// stopWaves returns the apps other than tgo grouped in the order they
+// should be stopped: the reverse of the order they were started in. The
+// apps in a group can be stopped at the same time. If the dependencies are
+// not valid it falls back to one app at a time, in reverse array order.
+func stopWaves() [][]int {
+	var groups [][]int
+	waves, err := appWaves()
+	if err != nil {
+		for i := len(envMap.Instances[envMap.ThisInst].Apps) - 1; i >= 0; i-- {
+			if i != envMap.ThisApp {
+				groups = append(groups, []int{i})
+			}
+		}
+		return groups
+	}
+	for w := len(waves) - 1; w >= 0; w-- {
+		var g []int
+		for n := len(waves[w]) - 1; n >= 0; n-- {
+			g = append(g, waves[w][n])
+		}
+		groups = append(groups, g)
+	}
+	return groups
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestAppWaves(t *testing.T) {
+	defer supervisedEnv(
+		appDescr{UID: "svc_test", DependsOn: []string{"svc"}},
+		appDescr{UID: "svc", DependsOn: []string{"db", "tgo0"}},
+		appDescr{UID: "db"},
+		appDescr{UID: "cache"},
+	)()
+	waves, err := appWaves()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := fmt.Sprint(waves); s != "[[3 4] [2] [1]]" {
+		t.Errorf("expected waves [[3 4] [2] [1]], got %s", s)
+	}
+	if s := fmt.Sprint(stopWaves()); s != "[[1] [2] [4 3]]" {
+		t.Errorf("expected stop order [[1] [2] [4 3]], got %s", s)
+	}
+
+	envMap.Instances[0].Apps[3].DependsOn = []string{"svc_test"}
+	if _, err := appWaves(); err == nil || !strings.Contains(err.Error(), "cycle among apps: db, svc, svc_test") {
+		t.Errorf("expected a cycle between db, svc and svc_test, got %v", err)
+	}
+	envMap.Instances[0].Apps[3].DependsOn = []string{"nosuchapp"}
+	if _, err := appWaves(); err == nil || !strings.Contains(err.Error(), "nosuchapp") {
+		t.Errorf("expected an unknown dependency error, got %v", err)
+	}
+}
+
+func TestStartApps(t *testing.T) {
+	defer supervisedEnv(
+		appDescr{UID: "svc", Name: "svc", RunCmd: "sleep 30", DependsOn: []string{"db"}},
+		appDescr{UID: "db", Name: "db", RunCmd: "sleep 30"},
+		appDescr{UID: "web", Name: "web", RunCmd: "sleep 30"},
+	)()
+	defer stopAllApps(0)
+	var msgs []StatusMsg
+	ts := fakeUhura(&msgs)
+	defer ts.Close()
+
+	if err := startApps(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !getProc("svc").Started.After(getProc("db").Started) {
+		t.Errorf("svc was started before db was ready")
+	}
+	var uids []string
+	for _, m := range msgs {
+		uids = append(uids, m.UID+" "+m.State)
+	}
+	if s := strings.Join(uids, ", "); s != "db INIT, web INIT, svc INIT" {
+		t.Errorf("expected db and web to be reported before svc, got %s", s)
+	}
+}
+
+func TestStartAppsBlocked(t *testing.T) {
+	defer supervisedEnv(
+		appDescr{UID: "blockdb", Name: "blockdb", RunCmd: "/nonexistent/blockdb"},
+		appDescr{UID: "blocksvc", Name: "blocksvc", RunCmd: "sleep 30", DependsOn: []string{"blockdb"}},
+	)()
+	var msgs []StatusMsg
+	ts := fakeUhura(&msgs)
+	defer ts.Close()
+
+	err := startApps(context.Background())
+	se, ok := err.(*stateError)
+	if !ok || se.App != 2 {
+		t.Fatalf("expected a stateError for blocksvc, got %v", err)
+	}
+	if getProc("blocksvc") != nil {
+		t.Errorf("blocksvc was started although blockdb did not start")
+	}
+}
+
+func TestStartAppsUnexpectedReply(t *testing.T) {
+	// nothing depends on odd, so only its own reply can stop the run
+	defer supervisedEnv(
+		appDescr{UID: "fine", Name: "fine", RunCmd: "sleep 30"},
+		scriptApp(t, "odd", "echo maybe\n"),
+	)()
+	defer stopAllApps(0)
+	var msgs []StatusMsg
+	ts := fakeUhura(&msgs)
+	defer ts.Close()
+
+	err := startApps(context.Background())
+	se, ok := err.(*stateError)
+	if !ok || se.App != 2 || !strings.Contains(se.Reason, "odd did not start: maybe") {
+		t.Fatalf("expected a stateError for odd, got %v", err)
+	}
+}
+
+func TestCheckEnvDescrDeps(t *testing.T) {
+	defer supervisedEnv(
+		appDescr{UID: "a", Name: "a", DependsOn: []string{"b"}},
+		appDescr{UID: "b", Name: "b", DependsOn: []string{"a"}},
+	)()
+	if err := checkEnvDescr(); err == nil {
+		t.Errorf("expected the cycle to be rejected")
+	}
+	envMap.Instances[0].Apps[2].DependsOn = []string{"tgo0", "nosuchapp"}
+	if err := checkEnvDescr(); err == nil || !strings.Contains(err.Error(), "nosuchapp") {
+		t.Errorf("expected the unknown dependency to be rejected, got %v", err)
+	}
+	envMap.Instances[0].Apps[2].DependsOn = []string{"tgo0"}
+	if err := checkEnvDescr(); err != nil {
+		t.Errorf("expected valid dependencies to be accepted, got %v", err)
+	}
+}
@@ -1,9 +1,45 @@
 // Test reading the environment descriptors that uhura sends us
 package main
 
-import "testing"
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
 
 func TestNewInstParse(t *testing.T) {
 	readEnvDescr("./test/utdata/uhura_map.json")
 	ulog("Number of instances: %d\n", len(envMap.Instances))
 }
+
+func TestStateTimeouts(t *testing.T) {
+	saved := envMap
+	defer func() { envMap = saved }()
+
+	js := `{"Timeouts":{"Init":60,"PollInit":5},"Instances":[{"InstName":"T","Apps":[
+		{"UID":"tgo0","Name":"tgo"},
+		{"UID":"slow","Name":"slow","Timeouts":{"Init":600,"Test":10800,"PollTest":30}},
+		{"UID":"fast","Name":"fast","Timeouts":{"PollInit":2,"PollReady":1}}]}]}`
+	envMap = envDescr{}
+	if err := json.Unmarshal([]byte(js), &envMap); err != nil {
+		t.Fatalf("could not unmarshal descriptor: %v", err)
+	}
+
+	var m = []struct {
+		state   string
+		timeout time.Duration
+		poll    time.Duration
+	}{
+		{"UNKNOWN", 30 * time.Minute, 0},
+		{"INIT", 10 * time.Minute, 2 * time.Second},
+		{"READY", 15 * time.Minute, 1 * time.Second},
+		{"TESTNOW", 30 * time.Minute, 0},
+		{"TEST", 3 * time.Hour, 10 * time.Second},
+	}
+	for i := 0; i < len(m); i++ {
+		to, p := stateTimeouts(m[i].state)
+		if to != m[i].timeout || p != m[i].poll {
+			t.Errorf("%s: expected timeout %v poll %v, got %v %v", m[i].state, m[i].timeout, m[i].poll, to, p)
+		}
+	}
+}
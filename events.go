@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//  Events.
+//
+//  Everything that happens to tgo and its apps is published as an event:
+//  states entered and exited, activation calls and their results, status
+//  posts to uhura, restarts and health changes. Subscribers each get a
+//  buffered channel; a subscriber that falls behind loses events rather
+//  than holding tgo up. The most recent events are kept so a client that
+//  reconnects can pick up where it left off.
+//
+//  /v1/events streams the events as Server-Sent Events. The event id is
+//  the sequence number, so the standard Last-Event-ID header resumes the
+//  stream.
+
+// the types of event
+const (
+	evStateEntered     = "state.entered"
+	evStateExited      = "state.exited"
+	evActivationStart  = "activation.start"
+	evActivationResult = "activation.result"
+	evStatusPosted     = "status.posted"
+	evRestart          = "restart"
+	evHealth           = "health"
+)
+
+// eventHistory is the number of events kept for clients that reconnect
+const eventHistory = 256
+
+// event is something that happened
+type event struct {
+	Seq      int64
+	Type     string
+	Time     time.Time
+	UID      string        `json:",omitempty"` // the app concerned
+	State    string        `json:",omitempty"` // the orchestrator state or posted status
+	Cmd      string        `json:",omitempty"` // the activation command
+	Reply    string        `json:",omitempty"` // the activation reply
+	Err      string        `json:",omitempty"` // what went wrong
+	Reason   string        `json:",omitempty"` // why a restart or health change happened
+	Healthy  *bool         `json:",omitempty"` // for health events
+	Duration time.Duration `json:",omitempty"` // time in the state or the activation
+}
+
+// eventBus delivers events to subscribers
+var eventBus = struct {
+	sync.Mutex
+	seq     int64
+	history []event
+	subs    map[chan event]struct{}
+}{subs: make(map[chan event]struct{})}
+
+// publish numbers and timestamps the event and sends it to all subscribers
+func publish(e event) {
+	eventBus.Lock()
+	defer eventBus.Unlock()
+	eventBus.seq++
+	e.Seq, e.Time = eventBus.seq, time.Now()
+	eventBus.history = append(eventBus.history, e)
+	if len(eventBus.history) > eventHistory {
+		eventBus.history = eventBus.history[len(eventBus.history)-eventHistory:]
+	}
+	for ch := range eventBus.subs {
+		select {
+		case ch <- e:
+		default: // the subscriber is not keeping up
+		}
+	}
+}
+
+// subscribe returns a channel that receives the events published after
+// those with sequence numbers up to since, including any that are still in
+// the history. Call unsubscribe when done.
+func subscribe(since int64) chan event {
+	ch := make(chan event, eventHistory)
+	eventBus.Lock()
+	for _, e := range eventBus.history {
+		if e.Seq > since {
+			ch <- e
+		}
+	}
+	eventBus.subs[ch] = struct{}{}
+	eventBus.Unlock()
+	return ch
+}
+
+// unsubscribe stops delivery to a channel returned by subscribe
+func unsubscribe(ch chan event) {
+	eventBus.Lock()
+	delete(eventBus.subs, ch)
+	eventBus.Unlock()
+}
+
+// lastEventSeq returns the sequence number of the latest event
+func lastEventSeq() int64 {
+	eventBus.Lock()
+	defer eventBus.Unlock()
+	return eventBus.seq
+}
+
+// sseKeepalive is how often a comment is sent on an idle stream so proxies
+// do not close it
+var sseKeepalive = 15 * time.Second
+
+// eventsHandler answers /v1/events with a stream of Server-Sent Events.
+// A client gets the events published from now on, or those after the id in
+// the Last-Event-ID header or the since parameter.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	since := lastEventSeq()
+	id := r.Header.Get("Last-Event-ID")
+	if id == "" {
+		id = r.URL.Query().Get("since")
+	}
+	if id != "" {
+		n, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			http.Error(w, "bad event id "+id, http.StatusBadRequest)
+			return
+		}
+		since = n
+	}
+
+	ch := subscribe(since)
+	defer unsubscribe(ch)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	tick := time.NewTicker(sseKeepalive)
+	defer tick.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-tick.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case e := <-ch:
+			b, _ := json.Marshal(&e)
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Type, b)
+		}
+		flusher.Flush()
+	}
+}
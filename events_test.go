@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readEvents reads Server-Sent Events from the stream until it has n of them
+func readEvents(t *testing.T, resp *http.Response, n int) []event {
+	var evs []event
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sc := bufio.NewScanner(resp.Body)
+		var typ string
+		for sc.Scan() {
+			line := sc.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				typ = line[len("event: "):]
+			case strings.HasPrefix(line, "data: "):
+				var e event
+				if err := json.Unmarshal([]byte(line[len("data: "):]), &e); err != nil {
+					t.Errorf("bad event data %q: %v", line, err)
+					return
+				}
+				if e.Type != typ {
+					t.Errorf("event type %q does not match data %q", typ, e.Type)
+				}
+				evs = append(evs, e)
+				if len(evs) == n {
+					return
+				}
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		resp.Body.Close()
+		<-done
+		t.Fatalf("expected %d events, got %d: %+v", n, len(evs), evs)
+	}
+	return evs
+}
+
+func TestEvents(t *testing.T) {
+	defer supervisedEnv(scriptApp(t, "evapp", "echo ok\n"))()
+	resetMetrics() // so the first state change has no state to exit
+	ts := httptest.NewServer(newCommsMux())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/v1/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("unexpected Content-Type %q", ct)
+	}
+
+	setCurrentState("StateEventsA")
+	setCurrentState("StateEventsB")
+	act(1, "start")
+	noteRestart("evapp", "restart 1 after exit code 2")
+	evs := readEvents(t, resp, 6)
+
+	want := []string{
+		evStateEntered + " StateEventsA",
+		evStateExited + " StateEventsA",
+		evStateEntered + " StateEventsB",
+		evActivationStart + " evapp start",
+		evActivationResult + " evapp start ok",
+		evRestart + " evapp restart 1 after exit code 2",
+	}
+	for i, e := range evs {
+		got := strings.Join(strings.Fields(fmt.Sprintf("%s %s %s %s %s %s", e.Type, e.UID, e.State, e.Cmd, e.Reply, e.Reason)), " ")
+		if got != want[i] {
+			t.Errorf("event %d: expected %q, got %q", i, want[i], got)
+		}
+		if i > 0 && e.Seq != evs[i-1].Seq+1 {
+			t.Errorf("event %d: sequence %d does not follow %d", i, e.Seq, evs[i-1].Seq)
+		}
+	}
+
+	// a client that reconnects gets what it missed
+	req, _ := http.NewRequest("GET", ts.URL+"/v1/events", nil)
+	req.Header.Set("Last-Event-ID", fmt.Sprint(evs[3].Seq))
+	resp2, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp2.Body.Close()
+	if again := readEvents(t, resp2, 2); again[0].Seq != evs[4].Seq || again[1].Type != evRestart {
+		t.Errorf("resumed stream: unexpected events %+v", again)
+	}
+}
+
+func TestHealthEvents(t *testing.T) {
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer supervisedEnv(appDescr{UID: "evhealth", Name: "evhealth", UPort: serverPort(t, hs), Health: &healthDescr{HTTP: "/"}})()
+	since := lastEventSeq()
+	act(1, "ready")
+	act(1, "ready")
+	hs.Close()
+	act(1, "ready")
+
+	ch := subscribe(since)
+	defer unsubscribe(ch)
+	var health []bool
+	for len(ch) > 0 {
+		if e := <-ch; e.Type == evHealth && e.UID == "evhealth" {
+			health = append(health, *e.Healthy)
+		}
+	}
+	if fmt.Sprint(health) != "[true false]" {
+		t.Errorf("expected health to change to true then false, got %v", health)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+//  Health checks.
+//
+//  An app can describe how tgo should tell whether it is ready instead of
+//  asking its activate.sh script. For example:
+//
+//      "Health": {"HTTP": "/health", "Successes": 2, "Failures": 10}
+//
+//  makes tgo GET http://localhost:<UPort>/health each time it polls the
+//  app during INIT and READY. The app is ready once the check has passed
+//  2 times in a row. If it fails 10 times in a row the app is BLOCKED.
+//
+//  HTTP, TCP and Cmd can be combined; every check that is configured must
+//  pass. For apps with a RunCmd, the process must also still be running.
+
+// healthDescr describes the health checks for an app
+type healthDescr struct {
+	HTTP      string // path to GET on the app's UPort, e.g. /health
+	Status    int    // the HTTP status that means healthy, default 200
+	TCP       bool   // check that the app's UPort accepts connections
+	Cmd       string // command run in the app's directory, if it has one, healthy if it exits 0
+	Timeout   int    // seconds allowed for each check, default 5
+	Successes int    // consecutive passes needed to be ready, default 1
+	Failures  int    // consecutive failures before the app is BLOCKED, 0 for no limit
+}
+
+// healthCount is the run of consecutive passes or failures for an app
+type healthCount struct {
+	passes   int
+	failures int
+	healthy  *bool // the result of the last check, nil before the first
+}
+
+// healthCounts holds the health check history, indexed by app UID
+var healthCounts = struct {
+	sync.Mutex
+	m map[string]*healthCount
+}{m: make(map[string]*healthCount)}
+
+// probeHealth runs each of the app's health checks once. It returns nil if
+// they all passed, or the first failure.
+func probeHealth(ctx context.Context, a *appDescr) error {
+	h := a.Health
+	timeout := 5 * time.Second
+	if h.Timeout > 0 {
+		timeout = time.Duration(h.Timeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	addr := fmt.Sprintf("localhost:%d", a.UPort)
+
+	if h.TCP {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return fmt.Errorf("tcp %s: %v", addr, err)
+		}
+		conn.Close()
+	}
+	if h.HTTP != "" {
+		url := "http://" + addr + h.HTTP
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("GET %s: %v", url, err)
+		}
+		resp.Body.Close()
+		want := h.Status
+		if want == 0 {
+			want = http.StatusOK
+		}
+		if resp.StatusCode != want {
+			return fmt.Errorf("GET %s: %s, expected %d", url, resp.Status, want)
+		}
+	}
+	if h.Cmd != "" {
+		args := strings.Fields(h.Cmd)
+		if len(args) == 0 {
+			return fmt.Errorf("empty health command %q", h.Cmd)
+		}
+		c := exec.CommandContext(ctx, args[0], args[1:]...)
+		if fi, err := os.Stat(appDir(a)); err == nil && fi.IsDir() {
+			c.Dir = appDir(a)
+		}
+		if out, err := c.CombinedOutput(); err != nil {
+			return fmt.Errorf("%s: %v %s", h.Cmd, err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+// checkHealthDescr returns an error if the app's health checks cannot be
+// run
+func checkHealthDescr(a *appDescr) error {
+	if a.Health != nil && a.Health.Cmd != "" && len(strings.Fields(a.Health.Cmd)) == 0 {
+		return fmt.Errorf("app %s has an empty health Cmd", a.UID)
+	}
+	return nil
+}
+
+// checkHealth answers the ready command for an app with health checks. It
+// replies "ok" once the checks have passed Successes times in a row. It
+// returns an error once they have failed Failures times in a row.
+func checkHealth(ctx context.Context, i int) (string, error) {
+	a := &envMap.Instances[envMap.ThisInst].Apps[i]
+	if a.RunCmd != "" {
+		if r := procReady(a); r != "ok" {
+			return r, nil
+		}
+	}
+	err := probeHealth(ctx, a)
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+
+	healthCounts.Lock()
+	hc, ok := healthCounts.m[a.UID]
+	if !ok {
+		hc = &healthCount{}
+		healthCounts.m[a.UID] = hc
+	}
+	if err == nil {
+		hc.passes++
+		hc.failures = 0
+	} else {
+		hc.failures++
+		hc.passes = 0
+	}
+	passes, failures := hc.passes, hc.failures
+	need := a.Health.Successes
+	if need < 1 {
+		need = 1
+	}
+	healthy := passes >= need
+	changed := hc.healthy == nil || *hc.healthy != healthy
+	hc.healthy = &healthy
+	healthCounts.Unlock()
+
+	if changed {
+		e := event{Type: evHealth, UID: a.UID, Healthy: &healthy}
+		if err != nil {
+			e.Reason = err.Error()
+		}
+		publish(e)
+	}
+	switch {
+	case err == nil && passes >= need:
+		return "ok", nil
+	case err == nil:
+		return fmt.Sprintf("error health check passed %d of %d times needed", passes, need), nil
+	case a.Health.Failures > 0 && failures >= a.Health.Failures:
+		return "", appError(i, "health check failed %d times in a row: %v", failures, err)
+	}
+	ulog("health check for %s failed (%d in a row): %v\n", a.UID, failures, err)
+	return fmt.Sprintf("error health check failed: %v", err), nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// serverPort returns the port an httptest server is listening on
+func serverPort(t *testing.T, ts *httptest.Server) int {
+	_, port, err := net.SplitHostPort(ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+func TestHealthHTTP(t *testing.T) {
+	healthy := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" || !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+	defer supervisedEnv(appDescr{UID: "web", Name: "web", UPort: serverPort(t, ts),
+		Health: &healthDescr{HTTP: "/health", Successes: 2, Failures: 3}})()
+
+	ready := func() (string, error) { return activateCmd(context.Background(), 1, "ready") }
+	for n := 1; n <= 2; n++ {
+		if s, err := ready(); err != nil || !strings.HasPrefix(s, "error") {
+			t.Fatalf("unhealthy check %d: expected an error reply, got %q, %v", n, s, err)
+		}
+	}
+	healthy = true
+	if s, _ := ready(); s == "ok" {
+		t.Errorf("expected 2 passes to be needed, ready after 1")
+	}
+	if s, err := ready(); s != "ok" || err != nil {
+		t.Errorf("expected ok after 2 passes, got %q, %v", s, err)
+	}
+
+	healthy = false
+	ready()
+	ready()
+	if _, err := ready(); err == nil {
+		t.Errorf("expected an error after 3 failures in a row")
+	} else if se, ok := err.(*stateError); !ok || se.App != 1 {
+		t.Errorf("expected a stateError for the app, got %v", err)
+	}
+}
+
+func TestHealthTCPAndCmd(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	defer supervisedEnv(
+		appDescr{UID: "tcp", Name: "tcp", UPort: port, Health: &healthDescr{TCP: true}},
+		appDescr{UID: "cmdok", Name: "cmdok", Health: &healthDescr{Cmd: "true"}},
+		appDescr{UID: "cmdfail", Name: "cmdfail", Health: &healthDescr{Cmd: "false"}},
+		appDescr{UID: "cmdblank", Name: "cmdblank", Health: &healthDescr{Cmd: "  \t"}},
+	)()
+
+	if s := act(1, "ready"); s != "ok" {
+		t.Errorf("tcp: expected ok while listening, got %q", s)
+	}
+	l.Close()
+	if s := act(1, "ready"); !strings.HasPrefix(s, "error") {
+		t.Errorf("tcp: expected an error after the listener closed, got %q", s)
+	}
+	if s := act(2, "ready"); s != "ok" {
+		t.Errorf("cmd true: expected ok, got %q", s)
+	}
+	if s := act(3, "ready"); !strings.HasPrefix(s, "error") {
+		t.Errorf("cmd false: expected an error, got %q", s)
+	}
+
+	// a blank Cmd is rejected with the descriptor, and fails if it gets this far
+	if err := checkEnvDescr(); err == nil || !strings.Contains(err.Error(), "cmdblank has an empty health Cmd") {
+		t.Errorf("expected the blank Cmd to be rejected, got %v", err)
+	}
+	if s := act(4, "ready"); !strings.HasPrefix(s, "error") {
+		t.Errorf("blank cmd: expected an error, got %q", s)
+	}
+}
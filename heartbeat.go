@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+//  Heartbeat.
+//
+//  tgo can tell uhura it is alive between state transitions by posting a
+//  HeartbeatMsg to <UhuraURL>heartbeat/ every Heartbeat seconds. The
+//  heartbeat starts with the state machine and stops before TERM. It is
+//  off unless Heartbeat is set in the environment descriptor, and with
+//  status transports other than http. Heartbeats are not retried; a
+//  missed one is logged and the next one is sent on schedule.
+
+// HeartbeatMsg is the message tgo posts to uhura to say it is alive.
+type HeartbeatMsg struct {
+	InstName       string
+	UID            string
+	State          string            // the state tgo is in
+	StateSecs      int               // how long tgo has been in that state
+	Apps           map[string]string // the state of each app, by UID
+	Uptime         int               // seconds since tgo started
+	LastActivation string            `json:",omitempty"` // the most recent activation and its reply
+	Tstamp         string
+}
+
+// heartbeatMsg returns a heartbeat describing what tgo is doing now
+func heartbeatMsg() HeartbeatMsg {
+	state, entered := currentState()
+	m := HeartbeatMsg{
+		InstName: envMap.Instances[envMap.ThisInst].InstName,
+		UID:      envMap.Instances[envMap.ThisInst].Apps[envMap.ThisApp].UID,
+		State:    state,
+		Apps:     map[string]string{},
+		Uptime:   int(uptime() / time.Second),
+		Tstamp:   protoTimestamp(),
+	}
+	if !entered.IsZero() {
+		m.StateSecs = int(time.Since(entered) / time.Second)
+	}
+	for i := range envMap.Instances[envMap.ThisInst].Apps {
+		a := &envMap.Instances[envMap.ThisInst].Apps[i]
+		if i != envMap.ThisApp {
+			m.Apps[a.UID] = appStateName(appState(a))
+		}
+	}
+	if uid, r := latestActivation(); uid != "" {
+		m.LastActivation = fmt.Sprintf("%s %s: %s", uid, r.Cmd, r.Reply)
+		if r.Err != "" {
+			m.LastActivation += " (" + r.Err + ")"
+		}
+	}
+	return m
+}
+
+// postHeartbeat sends one heartbeat to uhura
+func postHeartbeat(ctx context.Context, client *http.Client) error {
+	b, err := json.Marshal(heartbeatMsg())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", envMap.UhuraURL+"heartbeat/", bytes.NewBuffer(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := signRequest(req, b); err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("heartbeat: %s", resp.Status)
+	}
+	return nil
+}
+
+// startHeartbeat starts sending heartbeats to uhura if they are configured.
+// The returned function stops them and waits until any heartbeat being
+// sent has finished.
+func startHeartbeat(ctx context.Context) func() {
+	if envMap.Heartbeat <= 0 || !uhuraOverHTTP() || !uhuraWants(featHeartbeat) {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	interval := time.Duration(envMap.Heartbeat) * time.Second
+	go func() {
+		defer close(done)
+		client, err := uhuraClient(interval)
+		if err != nil {
+			ulog("cannot send heartbeats: %v\n", err)
+			return
+		}
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				if err := postHeartbeat(ctx, client); err != nil && ctx.Err() == nil {
+					ulog("could not send heartbeat: %v\n", err)
+				}
+			}
+		}
+	}()
+	return func() { cancel(); <-done }
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHeartbeat(t *testing.T) {
+	defer supervisedEnv(appDescr{UID: "svc", Name: "svc", RunCmd: "sleep 30"})()
+	defer stopAllApps(0)
+	var mu sync.Mutex
+	var beats []HeartbeatMsg
+	arrived := make(chan struct{}, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/heartbeat/" {
+			t.Errorf("heartbeat posted to %s", r.URL.Path)
+		}
+		var m HeartbeatMsg
+		json.NewDecoder(r.Body).Decode(&m)
+		mu.Lock()
+		beats = append(beats, m)
+		mu.Unlock()
+		select {
+		case arrived <- struct{}{}:
+		default:
+		}
+	}))
+	defer ts.Close()
+	envMap.UhuraURL = ts.URL + "/"
+
+	if act(1, "start") != "ok" {
+		t.Fatal("could not start svc")
+	}
+	setAppState(&envMap.Instances[0].Apps[1], STATEInitializing)
+	setCurrentState("INIT")
+	defer setCurrentState("")
+
+	envMap.Heartbeat = 1
+	stop := startHeartbeat(context.Background())
+	for i := 0; i < 2; i++ {
+		select {
+		case <-arrived:
+		case <-time.After(5 * time.Second):
+			stop()
+			t.Fatalf("expected 2 heartbeats, got %d", i)
+		}
+	}
+	stop()
+	mu.Lock()
+	n := len(beats)
+	mu.Unlock()
+	if n < 2 {
+		t.Fatalf("expected at least 2 heartbeats, got %d", n)
+	}
+	m := beats[0]
+	if m.State != "INIT" || m.Apps["svc"] != "INIT" || m.LastActivation != "svc start: ok" || m.InstName != "SuperviseTest" {
+		t.Errorf("unexpected heartbeat: %+v", m)
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(beats) != n {
+		t.Errorf("heartbeats continued after they were stopped")
+	}
+}
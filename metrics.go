@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//  Metrics.
+//
+//  tgo serves /metrics on its command port in the Prometheus text
+//  exposition format so bring-up times can be charted across many runs.
+//  The format is simple enough that it is written by hand here rather
+//  than pulling in a client library.
+//
+//  tgo_state_seconds_total           time spent in each orchestrator state
+//  tgo_state_entries_total           how often each state was entered
+//  tgo_state                         1 for the state tgo is in
+//  tgo_app_state                     1 for the state each app is in
+//  tgo_activation_duration_seconds   activation latency by app and action
+//  tgo_activations_total             activation outcomes by app and action
+//  tgo_status_posts_total            attempts to post a status to uhura
+//  tgo_status_post_failures_total    posts that failed after all retries
+//  tgo_restarts_total                restarts of each app
+//  tgo_uptime_seconds                how long tgo has been running
+
+// activationBuckets are the upper bounds, in seconds, of the activation
+// latency histogram
+var activationBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 120, 300}
+
+// histogram counts observations into activationBuckets
+type histogram struct {
+	counts []int // per bucket, not cumulative
+	count  int
+	sum    float64
+}
+
+// observe adds the value v to the histogram
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]int, len(activationBuckets))
+	}
+	for i, b := range activationBuckets {
+		if v <= b {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// actKey identifies an activation metric
+type actKey struct {
+	uid, action string
+}
+
+// outcomeKey identifies an activation outcome
+type outcomeKey struct {
+	uid, action, outcome string
+}
+
+// metrics holds the counters that are not already kept elsewhere
+var metrics = struct {
+	sync.Mutex
+	stateSecs    map[string]float64
+	stateEntries map[string]int
+	latency      map[actKey]*histogram
+	outcomes     map[outcomeKey]int
+	posts        map[string]int // by status
+	postFailures map[string]int // by status
+}{
+	stateSecs:    make(map[string]float64),
+	stateEntries: make(map[string]int),
+	latency:      make(map[actKey]*histogram),
+	outcomes:     make(map[outcomeKey]int),
+	posts:        make(map[string]int),
+	postFailures: make(map[string]int),
+}
+
+// metricState records that the orchestrator entered the named state, and
+// how long it spent in the state it left
+func metricState(left string, d time.Duration, entered string) {
+	metrics.Lock()
+	if left != "" {
+		metrics.stateSecs[left] += d.Seconds()
+	}
+	metrics.stateEntries[entered]++
+	metrics.Unlock()
+}
+
+// activationOutcome classifies an activation: failed if the script could
+// not be run or timed out, error if it replied with an error, otherwise ok
+func activationOutcome(reply string, err error) string {
+	switch {
+	case err != nil:
+		return "failed"
+	case replyIs(reply, "error"):
+		return "error"
+	}
+	return "ok"
+}
+
+// metricActivation records the latency and outcome of an activation
+func metricActivation(uid, action, reply string, err error, d time.Duration) {
+	metrics.Lock()
+	k := actKey{uid, action}
+	h, ok := metrics.latency[k]
+	if !ok {
+		h = &histogram{}
+		metrics.latency[k] = h
+	}
+	h.observe(d.Seconds())
+	metrics.outcomes[outcomeKey{uid, action, activationOutcome(reply, err)}]++
+	metrics.Unlock()
+}
+
+// metricPost records an attempt to post a status to uhura
+func metricPost(status string, failed bool) {
+	metrics.Lock()
+	if failed {
+		metrics.postFailures[status]++
+	} else {
+		metrics.posts[status]++
+	}
+	metrics.Unlock()
+}
+
+// labelValue escapes a Prometheus label value
+var labelValue = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace
+
+// promWriter writes metrics in the Prometheus text format
+type promWriter struct {
+	bytes.Buffer
+}
+
+// family writes the HELP and TYPE lines for a metric
+func (w *promWriter) family(name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes one sample. labels are name, value pairs.
+func (w *promWriter) sample(name string, v float64, labels ...string) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", labels[i], labelValue(labels[i+1]))
+		}
+		w.WriteByte('}')
+	}
+	fmt.Fprintf(w, " %g\n", v)
+}
+
+// sortedKeys returns the keys of a map of counts in order
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeMetrics writes all of tgo's metrics
+func writeMetrics(w *promWriter) {
+	state, entered := currentState()
+
+	metrics.Lock()
+	secs := make(map[string]float64)
+	for k, v := range metrics.stateSecs {
+		secs[k] = v
+	}
+	if state != "" {
+		secs[state] += time.Since(entered).Seconds() // include time in the current state
+	}
+	var states []string
+	for k := range secs {
+		states = append(states, k)
+	}
+	sort.Strings(states)
+	w.family("tgo_state_seconds_total", "counter", "Seconds spent in each orchestrator state.")
+	for _, s := range states {
+		w.sample("tgo_state_seconds_total", secs[s], "state", s)
+	}
+	w.family("tgo_state_entries_total", "counter", "Times each orchestrator state was entered.")
+	for _, s := range sortedKeys(metrics.stateEntries) {
+		w.sample("tgo_state_entries_total", float64(metrics.stateEntries[s]), "state", s)
+	}
+
+	var keys []actKey
+	for k := range metrics.latency {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].uid != keys[j].uid {
+			return keys[i].uid < keys[j].uid
+		}
+		return keys[i].action < keys[j].action
+	})
+	w.family("tgo_activation_duration_seconds", "histogram", "Activation call latency by app and action.")
+	for _, k := range keys {
+		h := metrics.latency[k]
+		n := 0
+		for i, b := range activationBuckets {
+			n += h.counts[i]
+			w.sample("tgo_activation_duration_seconds_bucket", float64(n), "uid", k.uid, "action", k.action, "le", fmt.Sprintf("%g", b))
+		}
+		w.sample("tgo_activation_duration_seconds_bucket", float64(h.count), "uid", k.uid, "action", k.action, "le", "+Inf")
+		w.sample("tgo_activation_duration_seconds_sum", h.sum, "uid", k.uid, "action", k.action)
+		w.sample("tgo_activation_duration_seconds_count", float64(h.count), "uid", k.uid, "action", k.action)
+	}
+
+	var outcomes []outcomeKey
+	for k := range metrics.outcomes {
+		outcomes = append(outcomes, k)
+	}
+	sort.Slice(outcomes, func(i, j int) bool {
+		a, b := outcomes[i], outcomes[j]
+		if a.uid != b.uid {
+			return a.uid < b.uid
+		}
+		if a.action != b.action {
+			return a.action < b.action
+		}
+		return a.outcome < b.outcome
+	})
+	w.family("tgo_activations_total", "counter", "Activation calls by app, action and outcome.")
+	for _, k := range outcomes {
+		w.sample("tgo_activations_total", float64(metrics.outcomes[k]), "uid", k.uid, "action", k.action, "outcome", k.outcome)
+	}
+
+	w.family("tgo_status_posts_total", "counter", "Attempts to post a status to uhura.")
+	for _, s := range sortedKeys(metrics.posts) {
+		w.sample("tgo_status_posts_total", float64(metrics.posts[s]), "status", s)
+	}
+	w.family("tgo_status_post_failures_total", "counter", "Status posts to uhura that failed after all retries.")
+	for _, s := range sortedKeys(metrics.postFailures) {
+		w.sample("tgo_status_post_failures_total", float64(metrics.postFailures[s]), "status", s)
+	}
+	metrics.Unlock()
+
+	apps := envMap.Instances[envMap.ThisInst].Apps
+	w.family("tgo_restarts_total", "counter", "Times each app has been restarted.")
+	for i := range apps {
+		w.sample("tgo_restarts_total", float64(restartCount(apps[i].UID)), "uid", apps[i].UID)
+	}
+
+	w.family("tgo_state", "gauge", "1 for the orchestrator state tgo is in.")
+	if state != "" {
+		w.sample("tgo_state", 1, "state", state)
+	}
+	w.family("tgo_app_state", "gauge", "1 for the state each app is in, 0 for the others.")
+	for i := range apps {
+		cur := appState(&apps[i])
+		for s, name := range appStateNames {
+			v := 0.0
+			if cur == s {
+				v = 1
+			}
+			w.sample("tgo_app_state", v, "uid", apps[i].UID, "state", name)
+		}
+	}
+	w.family("tgo_uptime_seconds", "gauge", "Seconds since tgo started.")
+	w.sample("tgo_uptime_seconds", uptime().Seconds())
+}
+
+// metricsHandler answers /metrics
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var pw promWriter
+	writeMetrics(&pw)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(pw.Bytes())
+}
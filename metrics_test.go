@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	var h histogram
+	for _, v := range []float64{0.001, 0.07, 0.07, 400} {
+		h.observe(v)
+	}
+	if h.count != 4 || h.counts[0] != 1 || h.counts[2] != 2 {
+		t.Errorf("unexpected histogram %+v", h)
+	}
+	var w promWriter
+	w.sample("m", 1.5, "a", `say "hi"`+"\n")
+	if s := w.String(); s != "m{a=\"say \\\"hi\\\"\\n\"} 1.5\n" {
+		t.Errorf("bad sample line %q", s)
+	}
+}
+
+// resetMetrics forgets the orchestrator state and all metrics
+func resetMetrics() {
+	runInfo.Lock()
+	runInfo.state = ""
+	runInfo.Unlock()
+	metrics.Lock()
+	metrics.stateSecs = make(map[string]float64)
+	metrics.stateEntries = make(map[string]int)
+	metrics.latency = make(map[actKey]*histogram)
+	metrics.outcomes = make(map[outcomeKey]int)
+	metrics.posts = make(map[string]int)
+	metrics.postFailures = make(map[string]int)
+	metrics.Unlock()
+}
+
+func TestMetrics(t *testing.T) {
+	resetMetrics()
+	defer supervisedEnv(
+		scriptApp(t, "metok", "echo ok\n"),
+		scriptApp(t, "metbad", "echo error broken\n"),
+	)()
+	var msgs []StatusMsg
+	uhura := fakeUhura(&msgs)
+	defer uhura.Close()
+
+	setCurrentState("StateMetricsA")
+	time.Sleep(10 * time.Millisecond)
+	setCurrentState("StateMetricsB")
+	act(1, "start")
+	act(2, "start")
+	act(2, "start")
+	var r StatusReply
+	if _, err := PostStatus(&StatusMsg{State: "METRICS", UID: "tgo0"}, &r); err != nil {
+		t.Fatal(err)
+	}
+	before := restartCount("metok")
+	noteRestart("metok", "test")
+	envMap.Instances[0].Apps[1].State = STATEReady
+
+	ts := httptest.NewServer(newCommsMux())
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("unexpected Content-Type %q", ct)
+	}
+	out := string(b)
+	for _, want := range []string{
+		`tgo_state_entries_total{state="StateMetricsA"} 1`,
+		`tgo_state_seconds_total{state="StateMetricsA"} 0.0`,
+		`tgo_state{state="StateMetricsB"} 1`,
+		`tgo_activation_duration_seconds_count{uid="metbad",action="start"} 2`,
+		`tgo_activation_duration_seconds_bucket{uid="metok",action="start",le="+Inf"} 1`,
+		`tgo_activations_total{uid="metok",action="start",outcome="ok"} 1`,
+		`tgo_activations_total{uid="metbad",action="start",outcome="error"} 2`,
+		`tgo_status_posts_total{status="METRICS"} 1`,
+		fmt.Sprintf(`tgo_restarts_total{uid="metok"} %d`, before+1),
+		`tgo_app_state{uid="metok",state="READY"} 1`,
+		`tgo_app_state{uid="metbad",state="READY"} 0`,
+		"# TYPE tgo_activation_duration_seconds histogram",
+		"tgo_uptime_seconds ",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics do not contain %q", want)
+		}
+	}
+	if t.Failed() {
+		t.Log(out)
+	}
+}
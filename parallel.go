@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+//  Parallel activation.
+//
+//  Activation scripts for different apps are run at the same time so that
+//  an instance comes up in roughly the time of its slowest app rather than
+//  the sum of them all. The number of scripts running at once is limited
+//  by Workers in the environment descriptor. Scripts run in their app's
+//  directory (exec.Cmd.Dir); tgo never changes its own working directory.
+//
+//  Only the scripts run concurrently. Their replies are handled in array
+//  order, so the log and the status messages sent to uhura come out in
+//  the same order every run.
+
+// defaultWorkers is the number of activation scripts run at once when the
+// environment descriptor does not say
+const defaultWorkers = 8
+
+// workerLimit returns the maximum number of activation scripts to run at once
+func workerLimit() int {
+	if envMap.Workers > 0 {
+		return envMap.Workers
+	}
+	return defaultWorkers
+}
+
+// forEachApp calls f for each of the apps in idx, running up to
+// workerLimit() calls at a time. n is the position of app i in idx. It
+// returns when all the calls have returned.
+func forEachApp(idx []int, f func(n, i int)) {
+	sem := make(chan struct{}, workerLimit())
+	var wg sync.WaitGroup
+	for n, i := range idx {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(n, i int) {
+			defer func() { <-sem; wg.Done() }()
+			f(n, i)
+		}(n, i)
+	}
+	wg.Wait()
+}
+
+// activation is the result of running an activation command for an app
+type activation struct {
+	reply string
+	err   error
+}
+
+// activateApps runs the activation command cmd for each of the apps in idx
+// concurrently. It returns the results in the same order as idx.
+func activateApps(ctx context.Context, idx []int, cmd string) []activation {
+	res := make([]activation, len(idx))
+	forEachApp(idx, func(n, i int) {
+		res[n].reply, res[n].err = activateCmd(ctx, i, cmd)
+	})
+	return res
+}
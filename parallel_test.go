@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkerLimit(t *testing.T) {
+	defer supervisedEnv()()
+	envMap.Workers = 2
+
+	var mu sync.Mutex
+	running, most := 0, 0
+	forEachApp([]int{1, 2, 3, 4, 5, 6}, func(n, i int) {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+	})
+	if most != 2 {
+		t.Errorf("expected at most 2 workers at a time, got %d", most)
+	}
+}
+
+// scriptApp writes an activate.sh containing script into a new directory
+// and returns an app installed in that directory
+func scriptApp(t *testing.T, uid, script string) appDescr {
+	dir := filepath.Join(t.TempDir(), uid)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "activate.sh"), []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	wd, _ := os.Getwd()
+	name, err := filepath.Rel(filepath.Dir(wd), dir) // appDir is relative to tgo's parent
+	if err != nil {
+		t.Fatal(err)
+	}
+	return appDescr{UID: uid, Name: name}
+}
+
+func TestActivateParallel(t *testing.T) {
+	slow := "sleep 0.5\necho ok\n"
+	defer supervisedEnv(scriptApp(t, "a1", slow), scriptApp(t, "a2", slow), scriptApp(t, "a3", slow))()
+	wd, _ := os.Getwd()
+
+	start := time.Now()
+	res := activateApps(context.Background(), []int{1, 2, 3}, "start")
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("expected the scripts to run concurrently, took %v", d)
+	}
+	for n, r := range res {
+		if r.err != nil || r.reply != "ok\n" {
+			t.Errorf("app %d: expected ok, got %q, %v", n+1, r.reply, r.err)
+		}
+	}
+	if now, _ := os.Getwd(); now != wd {
+		t.Errorf("working directory changed from %s to %s", wd, now)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//  Process groups.
+//
+//  Every process tgo starts, supervised processes and activate.sh scripts
+//  alike, is the leader of a new process group. Whatever an app starts is
+//  in that group too, unless it moves itself out with setsid or by
+//  daemonizing, so tgo can stop the whole app and not just the process it
+//  started:
+//
+//  - a supervised app is sent SIGTERM as a group. Anything in the group
+//    still running at the end of the grace period is sent SIGKILL.
+//  - for other apps tgo remembers the group of the last 'activate.sh
+//    start' or 'activate.sh test'. Once 'activate.sh stop' has replied, or
+//    run out of time, anything left in that group is given the rest of
+//    the grace period to exit and is then sent SIGKILL.
+
+// appGroups holds the process group of each activate.sh app, indexed by
+// app UID
+var appGroups = struct {
+	sync.Mutex
+	m map[string]int
+}{m: make(map[string]int)}
+
+// groupPollInterval is how often groupExited checks a process group
+const groupPollInterval = 50 * time.Millisecond
+
+// newGroup returns the attributes that start a process in a group of its own
+func newGroup() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true}
+}
+
+// setAppGroup records the process group that the app's processes run in
+func setAppGroup(uid string, pgid int) {
+	appGroups.Lock()
+	defer appGroups.Unlock()
+	appGroups.m[uid] = pgid
+}
+
+// takeAppGroup returns and forgets the app's process group, 0 if there is
+// none
+func takeAppGroup(uid string) int {
+	appGroups.Lock()
+	defer appGroups.Unlock()
+	pgid := appGroups.m[uid]
+	delete(appGroups.m, uid)
+	return pgid
+}
+
+// groupAlive reports whether any process in the group is still running.
+// Zombies do not count: nothing may be left to reap them. Where there is
+// no /proc any process in the group counts.
+func groupAlive(pgid int) bool {
+	stats, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil || len(stats) == 0 {
+		return syscall.Kill(-pgid, 0) == nil
+	}
+	for _, f := range stats {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			continue // it exited
+		}
+		// pid (comm) state ppid pgrp ...; comm may contain anything
+		s := string(b)
+		fields := strings.Fields(s[strings.LastIndex(s, ")")+1:])
+		if len(fields) < 3 || fields[0] == "Z" {
+			continue
+		}
+		if pg, _ := strconv.Atoi(fields[2]); pg == pgid {
+			return true
+		}
+	}
+	return false
+}
+
+// groupExited waits up to d for every process in the group to exit. It
+// reports whether they did.
+func groupExited(pgid int, d time.Duration) bool {
+	deadline := time.Now().Add(d)
+	for groupAlive(pgid) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(groupPollInterval)
+	}
+	return true
+}
+
+// signalGroup sends sig to every process in the group
+func signalGroup(pgid int, sig syscall.Signal) error {
+	return syscall.Kill(-pgid, sig)
+}
+
+// killGroup waits up to d for the group to exit, then sends SIGKILL to
+// anything in it that has not. It reports whether it had to.
+func killGroup(uid string, pgid int, d time.Duration) bool {
+	if groupExited(pgid, d) {
+		return false
+	}
+	ulog("%s: processes in group %d did not exit within %v, sending SIGKILL\n", uid, pgid, d)
+	if err := signalGroup(pgid, syscall.SIGKILL); err != nil {
+		ulog("could not kill process group %d: %v\n", pgid, err)
+	}
+	return true
+}
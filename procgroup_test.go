@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// childPid returns the pid an app wrote to child.pid in dir
+func childPid(t *testing.T, dir string) int {
+	for n := 0; n < 50; n++ {
+		if b, err := ioutil.ReadFile(filepath.Join(dir, "child.pid")); err == nil && len(b) > 0 {
+			pid, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+			return pid
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("no child.pid in %s", dir)
+	return 0
+}
+
+func TestStopProcKillsChildren(t *testing.T) {
+	// the parent exits on SIGTERM, its child ignores it
+	dir := t.TempDir()
+	script := filepath.Join(dir, "parent.sh")
+	body := "#!/bin/sh\n(trap '' TERM; exec sleep 30) &\necho $! > " + filepath.Join(dir, "child.pid") + "\nwait\n"
+	if err := ioutil.WriteFile(script, []byte(body), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer supervisedEnv(appDescr{UID: "parent", Name: "parent", RunCmd: script})()
+	if s := act(1, "start"); s != "ok" {
+		t.Fatalf("start: expected ok, got %q", s)
+	}
+	child := childPid(t, dir)
+	time.Sleep(100 * time.Millisecond) // let the child set its trap
+
+	if s := stopApp(1, 500*time.Millisecond); s != "ok" {
+		t.Errorf("stop: expected ok, got %q", s)
+	}
+	if groupAlive(getProc("parent").Pid) {
+		t.Errorf("the child, pid %d, survived the stop", child)
+	}
+}
+
+func TestStopActivateKillsGroup(t *testing.T) {
+	// 'activate.sh stop' says ok but leaves the app running
+	app := scriptApp(t, "leaky", `case $1 in
+start) (trap '' TERM; exec sleep 30) >/dev/null 2>&1 & echo $! > child.pid; echo ok;;
+*) echo ok;;
+esac
+`)
+	defer supervisedEnv(app)()
+	if s := act(1, "start"); !replyIs(s, "ok") {
+		t.Fatalf("start: expected ok, got %q", s)
+	}
+	dir := appDir(&envMap.Instances[0].Apps[1])
+	child := childPid(t, dir)
+	appGroups.Lock()
+	pgid := appGroups.m["leaky"]
+	appGroups.Unlock()
+	if pgid == 0 || !groupAlive(pgid) {
+		t.Fatalf("expected the app's process group to be recorded and running, got %d", pgid)
+	}
+
+	start := time.Now()
+	if s := stopApp(1, 500*time.Millisecond); !replyIs(s, "ok") {
+		t.Errorf("stop: expected ok, got %q", s)
+	}
+	if d := time.Since(start); d < 400*time.Millisecond || d > 3*time.Second {
+		t.Errorf("expected the app to be killed after its grace period, took %v", d)
+	}
+	if groupAlive(pgid) {
+		t.Errorf("the app, pid %d, survived the stop", child)
+	}
+}
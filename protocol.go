@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//  Wire protocol versions.
+//
+//  Version 1 is what uhura and tgo have always spoken: unversioned
+//  messages, RFC822 timestamps and integer reply codes. Version 2 adds
+//  to every message:
+//
+//      Version     the protocol version of the message
+//      RequestID   set on a request, echoed in its reply
+//      Code        the reply code as a string, see replyCodeNames
+//
+//  and uses RFC3339 timestamps. The fields are additions, so a version 1
+//  peer ignores them.
+//
+//  tgo speaks version 1 unless the environment descriptor sets Protocol
+//  to 2. Then tgo starts by POSTing a HELLO to uhura's hello/ endpoint
+//  with its version and features, and uhura replies with its own. Both
+//  sides use the lower version and the features they have in common. An
+//  uhura that does not answer the HELLO is taken to speak version 1.
+//  uhura can also send HELLO as a command.
+
+// the protocol versions
+const (
+	protoV1 = 1
+	protoV2 = 2
+
+	protocolVersion = protoV2 // the latest version tgo speaks
+)
+
+// the features tgo can offer uhura in a HELLO
+const (
+	featHeartbeat = "heartbeat"    // tgo posts heartbeats to heartbeat/
+	featArtifacts = "artifacts"    // tgo uploads artifact bundles to artifacts/
+	featTests     = "test-results" // tgo's DONE status carries test totals
+	featRestart   = "restart"      // tgo posts RESTART when it restarts an app
+	featHMAC      = "hmac"         // requests are signed with the shared secret
+)
+
+// tgoFeatures returns the features tgo offers in a HELLO
+func tgoFeatures() []string {
+	f := []string{featArtifacts, featRestart, featTests}
+	if envMap.Heartbeat > 0 {
+		f = append(f, featHeartbeat)
+	}
+	if envMap.Auth != nil {
+		f = append(f, featHMAC)
+	}
+	sort.Strings(f)
+	return f
+}
+
+// replyCodeNames are the version 2 names of the reply codes. uhura's old
+// InvalidState and RespInvalidState mean the same thing, so in version 2
+// they are both INVALID_STATE.
+var replyCodeNames = map[int]string{
+	RespOK:             "OK",
+	RespNoSuchInstance: "NO_SUCH_INSTANCE",
+	InvalidState:       "INVALID_STATE",
+	RespBadCmd:         "BAD_COMMAND",
+	RespInvalidState:   "INVALID_STATE",
+	RespUnauthorized:   "UNAUTHORIZED",
+}
+
+// replyCodeName returns the version 2 name of a reply code
+func replyCodeName(rc int) string {
+	if s, ok := replyCodeNames[rc]; ok {
+		return s
+	}
+	return fmt.Sprintf("CODE_%d", rc)
+}
+
+// replyCodeValue returns the reply code with the supplied version 2 name
+func replyCodeValue(name string) (int, bool) {
+	if name == "INVALID_STATE" {
+		return RespInvalidState, true
+	}
+	for rc, s := range replyCodeNames {
+		if s == name {
+			return rc, true
+		}
+	}
+	return 0, false
+}
+
+// normalize fills in whichever of ReplyCode and Code the sender left out,
+// so that the rest of tgo can keep checking ReplyCode. If both are present
+// Code wins, since a version 2 uhura may not set ReplyCode at all.
+func (r *StatusReply) normalize() {
+	if r.Code == "" {
+		r.Code = replyCodeName(r.ReplyCode)
+		return
+	}
+	if rc, ok := replyCodeValue(r.Code); ok {
+		r.ReplyCode = rc
+	} else {
+		r.ReplyCode = -1 // a code we don't know is not OK
+	}
+}
+
+// HelloMsg is sent by tgo to uhura to agree on a protocol version
+type HelloMsg struct {
+	Version   int
+	InstName  string
+	UID       string
+	Features  []string
+	RequestID string
+	Tstamp    string
+}
+
+// HelloReply is the answer to a HELLO, from uhura or from tgo
+type HelloReply struct {
+	Version   int
+	Features  []string
+	Code      string
+	RequestID string
+	Timestamp string
+}
+
+// protocol is what tgo and uhura have agreed on
+var protocol = struct {
+	sync.Mutex
+	version  int
+	features map[string]bool
+}{version: protoV1}
+
+// protoVersion returns the protocol version in use
+func protoVersion() int {
+	protocol.Lock()
+	defer protocol.Unlock()
+	return protocol.version
+}
+
+// setProtocol records the version and features a peer has offered, and
+// returns the version that will be used
+func setProtocol(version int, features []string) int {
+	if version > protocolVersion {
+		version = protocolVersion
+	}
+	if version < protoV1 {
+		version = protoV1
+	}
+	mine := make(map[string]bool)
+	for _, f := range tgoFeatures() {
+		mine[f] = true
+	}
+	common := make(map[string]bool)
+	for _, f := range features {
+		if mine[f] {
+			common[f] = true
+		}
+	}
+	protocol.Lock()
+	protocol.version, protocol.features = version, common
+	protocol.Unlock()
+	return version
+}
+
+// uhuraWants reports whether uhura has agreed to a feature. Before version
+// 2 there is no agreement, and tgo does what it is configured to do.
+func uhuraWants(feature string) bool {
+	protocol.Lock()
+	defer protocol.Unlock()
+	return protocol.version < protoV2 || protocol.features[feature]
+}
+
+// protoTimestamp returns the current time in the format of the protocol in use
+func protoTimestamp() string {
+	if protoVersion() >= protoV2 {
+		return time.Now().Format(time.RFC3339)
+	}
+	return time.Now().Format(time.RFC822)
+}
+
+// newRequestID returns a random ID for a request
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// stampMsg adds the version 2 fields to a status message if they are in use
+func stampMsg(sm *StatusMsg) {
+	if v := protoVersion(); v >= protoV2 {
+		sm.Version = v
+		if sm.RequestID == "" {
+			sm.RequestID = newRequestID()
+		}
+	}
+}
+
+// hello offers uhura the protocol version in the environment descriptor
+// and agrees on the one to use. It does nothing unless version 2 or later
+// is asked for.
+func hello(ctx context.Context) {
+	if envMap.Protocol < protoV2 {
+		return
+	}
+	if !uhuraOverHTTP() {
+		ulog("HELLO: no uhura at %s with the %s transport, using protocol %d\n", envMap.UhuraURL, envMap.Transport.Type, protoV1)
+		return
+	}
+	v := envMap.Protocol
+	if v > protocolVersion {
+		v = protocolVersion
+	}
+	m := HelloMsg{
+		Version:   v,
+		InstName:  envMap.Instances[envMap.ThisInst].InstName,
+		UID:       envMap.Instances[envMap.ThisInst].Apps[envMap.ThisApp].UID,
+		Features:  tgoFeatures(),
+		RequestID: newRequestID(),
+		Tstamp:    time.Now().Format(time.RFC3339),
+	}
+	r, err := postHello(ctx, &m)
+	if err != nil {
+		ulog("HELLO: uhura does not speak protocol %d (%v), using protocol %d\n", v, err, protoV1)
+		setProtocol(protoV1, nil)
+		return
+	}
+	if r.Version > v {
+		r.Version = v
+	}
+	agreed := setProtocol(r.Version, r.Features)
+	protocol.Lock()
+	var common []string
+	for f := range protocol.features {
+		common = append(common, f)
+	}
+	protocol.Unlock()
+	sort.Strings(common)
+	ulog("HELLO: using protocol %d, features: %s\n", agreed, strings.Join(common, " "))
+}
+
+// postHello sends a HELLO to uhura and returns the reply
+func postHello(ctx context.Context, m *HelloMsg) (*HelloReply, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	client, err := uhuraClient(time.Duration(retrySettings().Timeout) * time.Second)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", envMap.UhuraURL+"hello/", bytes.NewBuffer(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := signRequest(req, b); err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	var r HelloReply
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("could not decode reply: %v", err)
+	}
+	switch {
+	case r.Version < protoV2:
+		return nil, fmt.Errorf("reply has version %d", r.Version)
+	case r.Code != "" && r.Code != "OK":
+		return nil, fmt.Errorf("uhura replied %s", r.Code)
+	case r.RequestID != m.RequestID:
+		return nil, fmt.Errorf("reply is for request %q, not %q", r.RequestID, m.RequestID)
+	}
+	return &r, nil
+}
+
+// answerHello answers a HELLO command from uhura
+func answerHello(w http.ResponseWriter, c *UCommand) {
+	v := c.Version
+	if v < protoV2 {
+		v = protoV1
+	}
+	agreed := setProtocol(v, c.Features)
+	ulog("HELLO from uhura: using protocol %d\n", agreed)
+	r := HelloReply{
+		Version:   protocolVersion,
+		Features:  tgoFeatures(),
+		Code:      replyCodeName(RespOK),
+		RequestID: c.RequestID,
+		Timestamp: time.Now().Format(time.RFC3339),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&r)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeReply(t *testing.T) {
+	for _, c := range []struct {
+		in        StatusReply
+		code      string
+		replyCode int
+	}{
+		{StatusReply{ReplyCode: RespOK}, "OK", RespOK},
+		{StatusReply{ReplyCode: InvalidState}, "INVALID_STATE", InvalidState},
+		{StatusReply{Code: "BAD_COMMAND"}, "BAD_COMMAND", RespBadCmd},
+		{StatusReply{Code: "INVALID_STATE"}, "INVALID_STATE", RespInvalidState},
+		{StatusReply{Code: "NO_SUCH_INSTANCE", ReplyCode: RespOK}, "NO_SUCH_INSTANCE", RespNoSuchInstance},
+		{StatusReply{Code: "SOMETHING_NEW"}, "SOMETHING_NEW", -1},
+	} {
+		r := c.in
+		r.normalize()
+		if r.Code != c.code || r.ReplyCode != c.replyCode {
+			t.Errorf("%+v: expected %s %d, got %s %d", c.in, c.code, c.replyCode, r.Code, r.ReplyCode)
+		}
+	}
+}
+
+// protoUhura is an uhura that speaks protocol 2 with the supplied features.
+// It records the status messages it receives.
+func protoUhura(features []string, msgs *[]StatusMsg) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hello/" {
+			var m HelloMsg
+			json.NewDecoder(r.Body).Decode(&m)
+			json.NewEncoder(w).Encode(&HelloReply{Version: protoV2, Features: features, Code: "OK", RequestID: m.RequestID})
+			return
+		}
+		var sm StatusMsg
+		json.NewDecoder(r.Body).Decode(&sm)
+		*msgs = append(*msgs, sm)
+		json.NewEncoder(w).Encode(&StatusReply{Status: "OK", Version: protoV2, Code: "OK", RequestID: sm.RequestID, Timestamp: time.Now().Format(time.RFC3339)})
+	}))
+	envMap.UhuraURL = ts.URL + "/"
+	return ts
+}
+
+func TestHelloV2(t *testing.T) {
+	defer supervisedEnv()()
+	defer setProtocol(protoV1, nil)
+	envMap.Protocol = protoV2
+	var msgs []StatusMsg
+	uhura := protoUhura([]string{featArtifacts, "teleport"}, &msgs)
+	defer uhura.Close()
+
+	hello(context.Background())
+	if v := protoVersion(); v != protoV2 {
+		t.Fatalf("expected protocol 2, got %d", v)
+	}
+	if !uhuraWants(featArtifacts) || uhuraWants(featRestart) || uhuraWants("teleport") {
+		t.Errorf("expected to agree on artifacts only")
+	}
+
+	var r StatusReply
+	PostFinalStatus(0, "RESTART", "")
+	if err := PostStatusAndGetReply(context.Background(), 0, "INIT", &r); err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 status messages, got %d", len(msgs))
+	}
+	sm := msgs[1]
+	if sm.Version != protoV2 || sm.RequestID == "" || sm.RequestID == msgs[0].RequestID {
+		t.Errorf("expected a version 2 message with a new request ID, got %+v", sm)
+	}
+	if _, err := time.Parse(time.RFC3339, sm.Tstamp); err != nil {
+		t.Errorf("expected an RFC3339 timestamp, got %q", sm.Tstamp)
+	}
+	if r.ReplyCode != RespOK || r.RequestID != sm.RequestID {
+		t.Errorf("unexpected reply %+v", r)
+	}
+}
+
+func TestHelloV1(t *testing.T) {
+	defer supervisedEnv()()
+	defer setProtocol(protoV1, nil)
+	envMap.Protocol = protoV2
+	var msgs []StatusMsg
+	uhura := fakeUhura(&msgs) // answers everything with a version 1 StatusReply
+	defer uhura.Close()
+
+	hello(context.Background())
+	if v := protoVersion(); v != protoV1 {
+		t.Fatalf("expected protocol 1 with an old uhura, got %d", v)
+	}
+	PostFinalStatus(0, "INIT", "")
+	sm := msgs[len(msgs)-1]
+	if sm.Version != 0 || sm.RequestID != "" {
+		t.Errorf("expected a version 1 message, got %+v", sm)
+	}
+	if _, err := time.Parse(time.RFC822, sm.Tstamp); err != nil {
+		t.Errorf("expected an RFC822 timestamp, got %q", sm.Tstamp)
+	}
+	b, _ := json.Marshal(&sm)
+	if strings.Contains(string(b), "Version") || strings.Contains(string(b), "RequestID") {
+		t.Errorf("version 1 message has version 2 fields: %s", b)
+	}
+	if !uhuraWants(featHeartbeat) {
+		t.Errorf("with protocol 1, tgo should do what it is configured to")
+	}
+}
+
+// send POSTs a command to tgo's command port and decodes the reply into r
+func send(t *testing.T, ts *httptest.Server, c UCommand, r interface{}) {
+	b, _ := json.Marshal(&c)
+	resp, err := http.Post(ts.URL+"/", "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(r); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCommandsV2(t *testing.T) {
+	defer supervisedEnv()()
+	defer setProtocol(protoV1, nil)
+	envMap.Heartbeat = 60
+	Tgo.StopComm = make(chan int, 1)
+	ts := httptest.NewServer(newCommsMux())
+	defer ts.Close()
+
+	var h HelloReply
+	send(t, ts, UCommand{Command: "HELLO", Version: protoV2, RequestID: "h1", Features: []string{featHeartbeat, featTests}}, &h)
+	if h.Version != protoV2 || h.RequestID != "h1" || h.Code != "OK" || len(h.Features) == 0 {
+		t.Errorf("unexpected HELLO reply %+v", h)
+	}
+	if protoVersion() != protoV2 || !uhuraWants(featHeartbeat) || uhuraWants(featArtifacts) {
+		t.Errorf("HELLO from uhura did not set the protocol")
+	}
+
+	var r StatusReply
+	send(t, ts, UCommand{Command: "STOP", Version: protoV2, RequestID: "s1"}, &r)
+	if r.Version != protoV2 || r.Code != "OK" || r.RequestID != "s1" {
+		t.Errorf("unexpected version 2 reply %+v", r)
+	}
+	if _, err := time.Parse(time.RFC3339, r.Timestamp); err != nil {
+		t.Errorf("expected an RFC3339 timestamp, got %q", r.Timestamp)
+	}
+	<-Tgo.StopComm
+
+	r = StatusReply{}
+	send(t, ts, UCommand{Command: "FROB"}, &r)
+	if r.Version != 0 || r.Code != "" || r.ReplyCode != RespBadCmd {
+		t.Errorf("expected a version 1 reply to a version 1 command, got %+v", r)
+	}
+	r = StatusReply{}
+	send(t, ts, UCommand{Command: "FROB", Version: protoV2}, &r)
+	if r.Code != "BAD_COMMAND" {
+		t.Errorf("expected BAD_COMMAND, got %+v", r)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+//  Activation script replies.
+//
+//  An activation script replies to tgo on stdout. The original format is a
+//  single word -- ok, done, testing -- or a line beginning with "error".
+//  Scripts may instead print a JSON object as the last line of their
+//  output:
+//
+//      {"Version": 1, "Status": "error", "Message": "db not reachable", "Retryable": true}
+//      {"Version": 1, "Status": "testing", "Progress": 40}
+//      {"Version": 1, "Status": "done", "Tests": {"Passed": 41, "Failed": 1, "Skipped": 2}}
+//
+//  Both formats are accepted for every command. Status is one of the
+//  words of the original format. A JSON reply without a Version, or that
+//  cannot be decoded, is treated as original format text.
+//
+//  An error reply with "Retryable": true is repeated until it succeeds or
+//  the state times out. One with "Retryable": false makes tgo report the
+//  app, and itself, BLOCKED. Errors in the original format don't say, and
+//  are handled as they always have been: logged, and repeated only by the
+//  commands tgo polls (ready, teststatus, and added states).
+
+// replyVersion is the latest version of the JSON reply format tgo knows
+const replyVersion = 1
+
+// testCounts are the test results an app reports
+type testCounts struct {
+	Passed  int
+	Failed  int
+	Skipped int
+}
+
+// actReply is the reply to an activation command
+type actReply struct {
+	Version   int         // 0 for the original text format
+	Status    string      // ok, done, testing, or error, always lower case
+	Message   string      // for errors, what went wrong
+	Retryable *bool       // for errors, whether the command might succeed if repeated; nil if the app didn't say
+	Progress  int         // percentage complete, for testing and long actions
+	Tests     *testCounts // test results, for done and testing
+}
+
+// parseReply decodes the output of an activation script
+func parseReply(out string) actReply {
+	text := strings.TrimRight(out, "\n\r")
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	if last := strings.TrimSpace(lines[len(lines)-1]); strings.HasPrefix(last, "{") {
+		var r actReply
+		if err := json.Unmarshal([]byte(last), &r); err == nil && r.Version > 0 {
+			if r.Version > replyVersion {
+				ulog("reply has version %d, tgo understands version %d: %s\n", r.Version, replyVersion, last)
+			}
+			r.Status = strings.ToLower(r.Status)
+			return r
+		}
+	}
+
+	// the original format
+	lower := strings.ToLower(text)
+	if lower == "error" || strings.HasPrefix(lower, "error ") {
+		return actReply{Status: "error", Message: strings.TrimSpace(text[len("error"):])}
+	}
+	return actReply{Status: lower, Message: text}
+}
+
+// replyIs reports whether the output of an activation script has the
+// supplied status
+func replyIs(out, status string) bool {
+	return parseReply(out).Status == status
+}
+
+// errUnknown, errRetryable and errFatal classify an error reply
+const (
+	errUnknown   = iota // the app didn't say; handled as tgo always has
+	errRetryable        // the command may succeed if it is repeated
+	errFatal            // the app cannot continue
+)
+
+// errClass returns how an error reply should be handled
+func (r actReply) errClass() int {
+	switch {
+	case r.Retryable == nil:
+		return errUnknown
+	case *r.Retryable:
+		return errRetryable
+	}
+	return errFatal
+}
+
+// replyError returns the error for a fatal error reply from the app at
+// index i to the command cmd, or nil if the reply is not a fatal error
+func replyError(i int, cmd string, r *actReply) error {
+	if r.Status != "error" || r.errClass() != errFatal {
+		return nil
+	}
+	a := &envMap.Instances[envMap.ThisInst].Apps[i]
+	return appError(i, "%s %s failed: %s%s", a.UID, cmd, r.Message, stderrTail(a))
+}
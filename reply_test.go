@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestParseReply(t *testing.T) {
+	tests := []struct {
+		out       string
+		status    string
+		message   string
+		retryable string // "", "true" or "false"
+	}{
+		{"ok\n", "ok", "ok", ""},
+		{"DONE\r\n", "done", "DONE", ""},
+		{"error", "error", "", ""}, // used to panic on retval[6:]
+		{"error - no activation script", "error", "- no activation script", ""}, // legacy message is unchanged
+		{"errors are fine\n", "errors are fine", "errors are fine", ""},         // not an error
+		{`{"Version": 1, "Status": "OK"}`, "ok", "", ""},                        // structured
+		{"starting db\n{\"Version\":1,\"Status\":\"error\",\"Message\":\"no db\",\"Retryable\":true}\n", "error", "no db", "true"},
+		{`{"Version": 1, "Status": "error", "Retryable": false}`, "error", "", "false"},
+		{`{"Status": "ok"}`, `{"status": "ok"}`, `{"Status": "ok"}`, ""},                            // no version: legacy text
+		{`{"Version": 1, "Status": `, `{"version": 1, "status": `, `{"Version": 1, "Status": `, ""}, // cannot decode
+	}
+	for _, tc := range tests {
+		r := parseReply(tc.out)
+		retryable := ""
+		if r.Retryable != nil {
+			retryable = map[bool]string{true: "true", false: "false"}[*r.Retryable]
+		}
+		if r.Status != tc.status || r.Message != tc.message || retryable != tc.retryable {
+			t.Errorf("parseReply(%q): expected %q, %q, %q, got %q, %q, %q",
+				tc.out, tc.status, tc.message, tc.retryable, r.Status, r.Message, retryable)
+		}
+	}
+
+	r := parseReply(`{"Version": 1, "Status": "done", "Progress": 100, "Tests": {"Passed": 41, "Failed": 1, "Skipped": 2}}`)
+	if r.Progress != 100 || r.Tests == nil || *r.Tests != (testCounts{41, 1, 2}) {
+		t.Errorf("expected progress and test counts, got %+v", r)
+	}
+}
+
+func TestRetryableStart(t *testing.T) {
+	// fails the first time it is run, then succeeds
+	flaky := scriptApp(t, "flaky", `if [ -f started ]; then echo ok; exit 0; fi
+touch started
+echo '{"Version": 1, "Status": "error", "Message": "port busy", "Retryable": true}'
+`)
+	defer supervisedEnv(flaky)()
+	envMap.Timeouts = &timeoutDescr{PollInit: 1}
+	var msgs []StatusMsg
+	ts := fakeUhura(&msgs)
+	defer ts.Close()
+
+	if err := startApps(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if envMap.Instances[0].Apps[1].State != STATEInitializing {
+		t.Errorf("expected flaky to be started on the second attempt")
+	}
+}
+
+func TestFatalReply(t *testing.T) {
+	defer supervisedEnv(
+		scriptApp(t, "doomed", `echo '{"Version": 1, "Status": "error", "Message": "bad license", "Retryable": false}'`),
+		scriptApp(t, "legacy", "echo error - something odd"),
+	)()
+	var msgs []StatusMsg
+	ts := fakeUhura(&msgs)
+	defer ts.Close()
+
+	err := startApps(context.Background())
+	se, ok := err.(*stateError)
+	if !ok || se.App != 1 || se.Reason != "doomed start failed: bad license" {
+		t.Fatalf("expected doomed to be BLOCKED, got %v", err)
+	}
+	if rc := fail(err); rc != 1 {
+		t.Errorf("expected exit code 1, got %d", rc)
+	}
+	var blocked []string
+	for _, m := range msgs {
+		if m.State == "BLOCKED" {
+			blocked = append(blocked, m.UID)
+		}
+	}
+	if s := strings.Join(blocked, ", "); s != "doomed, tgo0" {
+		t.Errorf("expected doomed and tgo to be reported BLOCKED, got %s", s)
+	}
+}
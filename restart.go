@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+//  Restart policies.
+//
+//  While the tests run, tgo watches the apps that have a restart policy
+//  and restarts any that stop. For example:
+//
+//      "Restart": {"Policy": "on-failure", "Max": 3, "Backoff": 2000}
+//
+//  restarts the app if it exits with a non-zero code, waiting 2s before
+//  the first restart and doubling the wait for each one after. Each
+//  restart is reported to uhura as a RESTART status that gives the exit
+//  code. If the app stops a fourth time it is BLOCKED.
+//
+//  tgo knows the exit code of apps it supervises (RunCmd). Other apps are
+//  polled with the ready command, and one that stops being ready is
+//  treated as having failed with exit code -1. After such an app is
+//  restarted tgo waits, up to the INIT timeout, for it to be ready again
+//  before polling it.
+//
+//  An unknown Policy is an error in the environment descriptor.
+
+// restartDescr describes what tgo does when an app stops during the tests
+type restartDescr struct {
+	Policy     string // never (the default), on-failure, or always
+	Max        int    // maximum number of restarts, 0 for no limit
+	Backoff    int    // milliseconds to wait before the first restart, doubled for each restart after, default 1000
+	MaxBackoff int    // milliseconds, upper limit on the wait between restarts, default 60000
+}
+
+// restartPolicy returns the app's restart policy
+func restartPolicy(a *appDescr) string {
+	if a.Restart == nil || a.Restart.Policy == "" {
+		return "never"
+	}
+	return strings.ToLower(a.Restart.Policy)
+}
+
+// checkRestart returns an error if the app's restart policy is not one tgo
+// knows
+func checkRestart(a *appDescr) error {
+	switch restartPolicy(a) {
+	case "never", "on-failure", "always":
+		return nil
+	}
+	return fmt.Errorf("app %s has unknown restart policy %q", a.UID, a.Restart.Policy)
+}
+
+// waitForExit waits until the app at index i stops running and returns its
+// exit code, or -1 if the code is not known. It returns an error if ctx is
+// cancelled first.
+func waitForExit(ctx context.Context, i int) (int, error) {
+	a := &envMap.Instances[envMap.ThisInst].Apps[i]
+	if a.RunCmd != "" {
+		p := getProc(a.UID)
+		if p == nil {
+			return -1, nil
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-p.done:
+		}
+		_, code, _ := p.status()
+		return code, nil
+	}
+	for {
+		if err := pause(ctx, pollInterval("TEST")); err != nil {
+			return 0, err
+		}
+		retval, err := activateCmd(ctx, i, "ready")
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		if err != nil || !replyIs(retval, "ok") {
+			return -1, nil
+		}
+	}
+}
+
+// waitRestarted waits for the restarted app at index i to reply "ok" to
+// the ready command. It gives up after the app's INIT timeout.
+func waitRestarted(ctx context.Context, i int) error {
+	a := &envMap.Instances[envMap.ThisInst].Apps[i]
+	limit := appTimeout(a, "INIT")
+	ctx, cancel := context.WithTimeout(ctx, limit)
+	defer cancel()
+	for {
+		retval, err := activateCmd(ctx, i, "ready")
+		if ctx.Err() != nil {
+			return fmt.Errorf("%s was not ready %v after it was restarted", a.UID, limit)
+		}
+		if err == nil && replyIs(retval, "ok") {
+			return nil
+		}
+		if pause(ctx, pollInterval("INIT")) != nil {
+			return fmt.Errorf("%s was not ready %v after it was restarted", a.UID, limit)
+		}
+	}
+}
+
+// restartApp starts the app at index i again and returns its reply. The
+// previous run's log files are closed first.
+func restartApp(ctx context.Context, i int) string {
+	a := &envMap.Instances[envMap.ThisInst].Apps[i]
+	closeAppOutput(a)
+	if a.RunCmd != "" {
+		return startProc(a)
+	}
+	retval, err := activateCmd(ctx, i, "start")
+	if err != nil {
+		return "error " + err.Error()
+	}
+	return retval
+}
+
+// watchApp restarts the app at index i according to its policy each time
+// it stops, until ctx is cancelled. If the app cannot be restarted, or has
+// used up its restarts, the error is sent to crashes.
+func watchApp(ctx context.Context, i int, crashes chan<- error) {
+	a := &envMap.Instances[envMap.ThisInst].Apps[i]
+	rp := a.Restart
+	rs := retryDescr{Backoff: rp.Backoff, MaxBackoff: rp.MaxBackoff}
+	if rs.Backoff <= 0 {
+		rs.Backoff = 1000
+	}
+	if rs.MaxBackoff <= 0 {
+		rs.MaxBackoff = 60 * 1000
+	}
+	for restarts := 1; ; restarts++ {
+		code, err := waitForExit(ctx, i)
+		if err != nil {
+			return
+		}
+		if code == 0 && restartPolicy(a) == "on-failure" {
+			ulog("%s exited with code 0, not restarting it\n", a.UID)
+			return
+		}
+		if rp.Max > 0 && restarts > rp.Max {
+			crashes <- appError(i, "%s exited with code %d after %d restart(s)%s", a.UID, code, rp.Max, stderrTail(a))
+			return
+		}
+		d := backoff(&rs, restarts)
+		ulog("%s exited with code %d, restart %d in %v\n", a.UID, code, restarts, d)
+		if pause(ctx, d) != nil {
+			return
+		}
+		retval := restartApp(ctx, i)
+		if ctx.Err() != nil {
+			return
+		}
+		if !replyIs(retval, "ok") {
+			crashes <- appError(i, "could not restart %s: %s", a.UID, strings.TrimRight(retval, "\n\r"))
+			return
+		}
+		reason := fmt.Sprintf("restart %d after exit code %d", restarts, code)
+		noteRestart(a.UID, reason)
+		if a.RunCmd == "" {
+			if err := waitRestarted(ctx, i); err != nil {
+				if ctx.Err() == nil {
+					crashes <- appError(i, "%v%s", err, stderrTail(a))
+				}
+				return
+			}
+		}
+		s := newStatusMsg(i, "RESTART", reason)
+		var r StatusReply
+		if err := PostMsgAndGetReply(ctx, i, &s, &r); err != nil && ctx.Err() == nil {
+			ulog("could not report the restart of %s: %v\n", a.UID, err)
+		}
+	}
+}
+
+// watchApps starts watching every app other than tgo that has a restart
+// policy. Errors for apps that could not be kept running are sent to the
+// returned channel. The returned function stops the watching and waits
+// for it to finish.
+func watchApps(ctx context.Context) (<-chan error, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	crashes := make(chan error, len(envMap.Instances[envMap.ThisInst].Apps))
+	var wg sync.WaitGroup
+	for i := 0; i < len(envMap.Instances[envMap.ThisInst].Apps); i++ {
+		a := &envMap.Instances[envMap.ThisInst].Apps[i]
+		if i == envMap.ThisApp || a.IsTest || restartPolicy(a) == "never" {
+			continue
+		}
+		ulog("watching %s, restart policy %s\n", a.UID, restartPolicy(a))
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			watchApp(ctx, i, crashes)
+		}(i)
+	}
+	return crashes, func() { cancel(); wg.Wait() }
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRestartOnFailure(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "crash.sh")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\nsleep 0.1\nexit 3\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer supervisedEnv(
+		appDescr{UID: "crash", Name: "crash", RunCmd: script,
+			Restart: &restartDescr{Policy: "on-failure", Max: 2, Backoff: 10}},
+		appDescr{UID: "clean", Name: "clean", RunCmd: "true",
+			Restart: &restartDescr{Policy: "on-failure", Backoff: 10}},
+		appDescr{UID: "nopolicy", Name: "nopolicy", RunCmd: "false"},
+	)()
+	var msgs []StatusMsg
+	ts := fakeUhura(&msgs)
+	defer ts.Close()
+	for i := 1; i <= 3; i++ {
+		act(i, "start")
+	}
+
+	crashes, stop := watchApps(context.Background())
+	defer stop()
+	select {
+	case err := <-crashes:
+		se, ok := err.(*stateError)
+		if !ok || se.App != 1 || !strings.Contains(se.Reason, "exited with code 3 after 2 restart(s)") {
+			t.Errorf("expected crash to be BLOCKED after 2 restarts, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("crash was not reported")
+	}
+
+	var restarts []string
+	for _, m := range msgs {
+		if m.State == "RESTART" {
+			restarts = append(restarts, m.UID+": "+m.Reason)
+		}
+	}
+	want := "crash: restart 1 after exit code 3, crash: restart 2 after exit code 3"
+	if s := strings.Join(restarts, ", "); s != want {
+		t.Errorf("expected restarts %q, got %q", want, s)
+	}
+}
+
+func TestRestartWaitsUntilReady(t *testing.T) {
+	// stopped when "up" is missing; a start takes a while to bring it back
+	app := scriptApp(t, "slow", `case $1 in
+start) rm -f up; (sleep 1.5; touch up) >/dev/null 2>&1 & echo ok;;
+ready) [ -f up ] && echo ok || echo starting;;
+*) echo ok;;
+esac
+`)
+	app.Restart = &restartDescr{Policy: "always", Max: 1, Backoff: 10}
+	defer supervisedEnv(app)()
+	envMap.Timeouts = &timeoutDescr{PollInit: 1, PollTest: 1}
+	up := filepath.Join(appDir(&envMap.Instances[0].Apps[1]), "up")
+	var msgs []StatusMsg
+	ts := fakeUhura(&msgs)
+	defer ts.Close()
+
+	crashes, stop := watchApps(context.Background())
+	os.Remove(up) // the app stops
+	select {
+	case err := <-crashes:
+		t.Errorf("a slow restart was counted as another crash: %v", err)
+	case <-time.After(5 * time.Second):
+	}
+	stop()
+
+	var restarts []string
+	for _, m := range msgs {
+		if m.State == "RESTART" {
+			restarts = append(restarts, m.UID+": "+m.Reason)
+		}
+	}
+	if s := strings.Join(restarts, ", "); s != "slow: restart 1 after exit code -1" {
+		t.Errorf("expected one restart, got %q", s)
+	}
+}
+
+func TestRestartFails(t *testing.T) {
+	app := scriptApp(t, "broken", `case $1 in
+start) echo error - no disk;;
+*) echo stopped;;
+esac
+`)
+	app.Restart = &restartDescr{Policy: "always", Backoff: 10}
+	defer supervisedEnv(app)()
+	envMap.Timeouts = &timeoutDescr{PollTest: 1}
+	var msgs []StatusMsg
+	ts := fakeUhura(&msgs)
+	defer ts.Close()
+
+	crashes, stop := watchApps(context.Background())
+	defer stop()
+	select {
+	case err := <-crashes:
+		if !strings.Contains(err.Error(), "could not restart broken: error - no disk") {
+			t.Errorf("unexpected crash: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the failed restart was not reported")
+	}
+	for _, m := range msgs {
+		if m.State == "RESTART" {
+			t.Errorf("RESTART posted for an app that was not restarted: %+v", m)
+		}
+	}
+}
+
+func TestUnknownRestartPolicy(t *testing.T) {
+	defer supervisedEnv(appDescr{UID: "svc", Name: "svc", Restart: &restartDescr{Policy: "on_failure"}})()
+	if err := checkEnvDescr(); err == nil || !strings.Contains(err.Error(), `unknown restart policy "on_failure"`) {
+		t.Errorf("expected the policy to be rejected, got %v", err)
+	}
+	envMap.Instances[0].Apps[1].Restart.Policy = "On-Failure"
+	if err := checkEnvDescr(); err != nil {
+		t.Errorf("expected On-Failure to be accepted, got %v", err)
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//  Test results.
+//
+//  After the tests are done, tgo collects the results each test app has
+//  left in its results directory (<app dir>/results unless the app's
+//  Results says otherwise). It understands:
+//
+//      *.xml   JUnit XML, a <testsuites> or a single <testsuite>
+//      *.tap   TAP, "ok" and "not ok" lines; SKIP and TODO count as skipped
+//      *.json  a summary: {"Passed": 41, "Failed": 1, "Skipped": 2}
+//
+//  If an app leaves no results, the counts from its JSON teststatus reply
+//  are used. The counts for the instance are sent to uhura with tgo's DONE
+//  status, and every suite is written to a single JUnit report. Without
+//  any results the report is only written if Report is set.
+
+// defaultReport is the file the merged JUnit report is written to
+const defaultReport = "junit.xml"
+
+// junitSuites is the root of a JUnit XML file
+type junitSuites struct {
+	XMLName  xml.Name     `xml:"testsuites"`
+	Name     string       `xml:"name,attr,omitempty"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Errors   int          `xml:"errors,attr"`
+	Skipped  int          `xml:"skipped,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+}
+
+// junitSuite is a JUnit test suite
+type junitSuite struct {
+	XMLName  xml.Name     `xml:"testsuite"`
+	Name     string       `xml:"name,attr"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Errors   int          `xml:"errors,attr"`
+	Skipped  int          `xml:"skipped,attr"`
+	Time     string       `xml:"time,attr,omitempty"`
+	Cases    []junitCase  `xml:"testcase"`
+	Suites   []junitSuite `xml:"testsuite"` // some tools nest suites
+}
+
+// junitCase is a JUnit test case
+type junitCase struct {
+	Name      string    `xml:"name,attr"`
+	Classname string    `xml:"classname,attr,omitempty"`
+	Time      string    `xml:"time,attr,omitempty"`
+	Failure   *junitMsg `xml:"failure"`
+	Error     *junitMsg `xml:"error"`
+	Skipped   *junitMsg `xml:"skipped"`
+}
+
+// junitMsg is the detail of a failed, errored or skipped test case
+type junitMsg struct {
+	Message string `xml:"message,attr,omitempty"`
+	Text    string `xml:",chardata"`
+}
+
+// counts returns the totals for the suite. The test cases are counted if
+// there are any; otherwise the suite's attributes are used.
+func (s *junitSuite) counts() testCounts {
+	var c testCounts
+	for _, tc := range s.Cases {
+		switch {
+		case tc.Failure != nil || tc.Error != nil:
+			c.Failed++
+		case tc.Skipped != nil:
+			c.Skipped++
+		default:
+			c.Passed++
+		}
+	}
+	if len(s.Cases) == 0 && len(s.Suites) == 0 {
+		c.Failed = s.Failures + s.Errors
+		c.Skipped = s.Skipped
+		c.Passed = s.Tests - c.Failed - c.Skipped
+	}
+	for i := range s.Suites {
+		c.add(s.Suites[i].counts())
+	}
+	return c
+}
+
+func (c *testCounts) add(o testCounts) {
+	c.Passed += o.Passed
+	c.Failed += o.Failed
+	c.Skipped += o.Skipped
+}
+
+// suiteFromCounts returns a suite that has only totals
+func suiteFromCounts(name string, c testCounts) junitSuite {
+	return junitSuite{Name: name, Tests: c.Passed + c.Failed + c.Skipped, Failures: c.Failed, Skipped: c.Skipped}
+}
+
+// parseJUnit reads the suites from a JUnit XML file
+func parseJUnit(r io.Reader) ([]junitSuite, error) {
+	d := xml.NewDecoder(r)
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		se, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch se.Name.Local {
+		case "testsuites":
+			var s junitSuites
+			err := d.DecodeElement(&s, &se)
+			return s.Suites, err
+		case "testsuite":
+			var s junitSuite
+			err := d.DecodeElement(&s, &se)
+			return []junitSuite{s}, err
+		}
+		return nil, fmt.Errorf("not JUnit XML: root element is <%s>", se.Name.Local)
+	}
+}
+
+// tapLine matches a TAP test line: ok or not ok, number, description, directive
+var tapLine = regexp.MustCompile(`^(not )?ok\b\s*(\d*)\s*-?\s*([^#]*)(#\s*(\w+).*)?$`)
+
+// parseTAP reads a TAP stream as a single suite
+func parseTAP(name string, r io.Reader) ([]junitSuite, error) {
+	s := junitSuite{Name: name}
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		m := tapLine.FindStringSubmatch(strings.TrimSpace(sc.Text()))
+		if m == nil {
+			continue
+		}
+		tc := junitCase{Name: strings.TrimSpace(m[3])}
+		if tc.Name == "" {
+			tc.Name = "test " + m[2]
+		}
+		switch directive := strings.ToUpper(m[5]); {
+		case directive == "SKIP" || directive == "TODO":
+			tc.Skipped = &junitMsg{Message: strings.TrimSpace(strings.TrimPrefix(m[4], "#"))}
+		case m[1] != "":
+			tc.Failure = &junitMsg{Message: "not ok"}
+		}
+		s.Cases = append(s.Cases, tc)
+	}
+	c := s.counts()
+	s.Tests, s.Failures, s.Skipped = len(s.Cases), c.Failed, c.Skipped
+	return []junitSuite{s}, sc.Err()
+}
+
+// parseSummary reads a JSON summary as a suite with only totals
+func parseSummary(name string, r io.Reader) ([]junitSuite, error) {
+	var c testCounts
+	if err := json.NewDecoder(r).Decode(&c); err != nil {
+		return nil, err
+	}
+	return []junitSuite{suiteFromCounts(name, c)}, nil
+}
+
+// resultsDir returns the directory in which the app leaves its results
+func resultsDir(a *appDescr) string {
+	if a.Results != "" {
+		return filepath.Join(appDir(a), a.Results)
+	}
+	return filepath.Join(appDir(a), "results")
+}
+
+// readResults parses every results file the app has left. Files that
+// cannot be parsed are logged and skipped.
+func readResults(a *appDescr) []junitSuite {
+	var suites []junitSuite
+	files, _ := filepath.Glob(filepath.Join(resultsDir(a), "*"))
+	sort.Strings(files)
+	for _, fname := range files {
+		name := a.UID + "." + strings.TrimSuffix(filepath.Base(fname), filepath.Ext(fname))
+		var parse func(io.Reader) ([]junitSuite, error)
+		switch strings.ToLower(filepath.Ext(fname)) {
+		case ".xml":
+			parse = parseJUnit
+		case ".tap":
+			parse = func(r io.Reader) ([]junitSuite, error) { return parseTAP(name, r) }
+		case ".json":
+			parse = func(r io.Reader) ([]junitSuite, error) { return parseSummary(name, r) }
+		default:
+			continue
+		}
+		f, err := os.Open(fname)
+		if err != nil {
+			ulog("could not read test results %s: %v\n", fname, err)
+			continue
+		}
+		s, err := parse(f)
+		f.Close()
+		if err != nil {
+			ulog("could not parse test results %s: %v\n", fname, err)
+			continue
+		}
+		for n := range s {
+			if !strings.HasPrefix(s[n].Name, a.UID+".") {
+				s[n].Name = a.UID + "." + s[n].Name // so the merged report says where each suite came from
+			}
+		}
+		suites = append(suites, s...)
+	}
+	return suites
+}
+
+// testResults holds the results collected for the instance
+var testResults = struct {
+	sync.Mutex
+	apps   map[string]testCounts // indexed by app UID
+	total  *testCounts           // nil until the results are collected
+	suites []junitSuite
+}{apps: make(map[string]testCounts)}
+
+// reportedCounts holds the test counts apps sent in their JSON replies,
+// indexed by app UID
+var reportedCounts = struct {
+	sync.Mutex
+	m map[string]testCounts
+}{m: make(map[string]testCounts)}
+
+// noteTestCounts remembers the test counts the app sent in a reply
+func noteTestCounts(a *appDescr, c *testCounts) {
+	if c == nil {
+		return
+	}
+	reportedCounts.Lock()
+	reportedCounts.m[a.UID] = *c
+	reportedCounts.Unlock()
+}
+
+// collectResults gathers the results of every test app and totals them
+func collectResults() {
+	var total testCounts
+	var all []junitSuite
+	apps := map[string]testCounts{}
+	for _, i := range testApps() {
+		a := &envMap.Instances[envMap.ThisInst].Apps[i]
+		suites := readResults(a)
+		if len(suites) == 0 {
+			reportedCounts.Lock()
+			c, ok := reportedCounts.m[a.UID]
+			reportedCounts.Unlock()
+			if !ok {
+				ulog("no test results from %s\n", a.UID)
+				continue
+			}
+			suites = []junitSuite{suiteFromCounts(a.UID, c)}
+		}
+		var c testCounts
+		for n := range suites {
+			c.add(suites[n].counts())
+		}
+		ulog("%s: %d passed, %d failed, %d skipped\n", a.UID, c.Passed, c.Failed, c.Skipped)
+		apps[a.UID] = c
+		total.add(c)
+		all = append(all, suites...)
+	}
+	testResults.Lock()
+	testResults.apps, testResults.total, testResults.suites = apps, &total, all
+	testResults.Unlock()
+	ulog("Test results: %d passed, %d failed, %d skipped\n", total.Passed, total.Failed, total.Skipped)
+}
+
+// testTotals returns the counts for the instance, or nil if they have not
+// been collected
+func testTotals() *testCounts {
+	testResults.Lock()
+	defer testResults.Unlock()
+	return testResults.total
+}
+
+// writeReport writes the collected suites to a single JUnit XML file
+func writeReport(path string) error {
+	testResults.Lock()
+	r := junitSuites{
+		Name:   fmt.Sprintf("%s/%s", envMap.EnvName, envMap.Instances[envMap.ThisInst].InstName),
+		Suites: testResults.suites,
+	}
+	testResults.Unlock()
+	for i := range r.Suites {
+		c := r.Suites[i].counts()
+		r.Tests += c.Passed + c.Failed + c.Skipped
+		r.Failures += c.Failed
+		r.Skipped += c.Skipped
+	}
+	b, err := xml.MarshalIndent(&r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append([]byte(xml.Header), append(b, '\n')...), 0644)
+}
+
+// StateResults collects the test results and writes the merged report.
+func StateResults(ctx context.Context) <-chan stateResult {
+	c := make(chan stateResult, 1)
+	go func() {
+		ulog("Entering StateResults\n")
+		collectResults()
+		testResults.Lock()
+		none := len(testResults.suites) == 0
+		testResults.Unlock()
+		path := envMap.Report
+		if path == "" {
+			path = defaultReport
+		}
+		if envMap.Report == "" && none {
+			ulog("no test results, no JUnit report written\n")
+		} else if err := writeReport(path); err != nil {
+			ulog("could not write JUnit report %s: %v\n", path, err)
+		} else {
+			ulog("JUnit report written to %s\n", path)
+		}
+		c <- stateResult{0, nil}
+	}()
+	return c
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const junitXML = `<?xml version="1.0"?>
+<testsuites>
+  <testsuite name="api" tests="4">
+    <testcase name="get"/>
+    <testcase name="put"><failure message="500">boom</failure></testcase>
+    <testcase name="delete"><skipped/></testcase>
+    <testcase name="list"><error message="timeout"/></testcase>
+  </testsuite>
+  <testsuite name="totals-only" tests="10" failures="1" errors="1" skipped="3"/>
+</testsuites>
+`
+
+const tapOutput = `1..4
+ok 1 - starts
+not ok 2 - answers
+ok 3 # SKIP no database
+not ok 4 - retries # TODO not written yet
+`
+
+func TestCollectResults(t *testing.T) {
+	app := scriptApp(t, "tests", "echo ok\n")
+	app.IsTest = true
+	none := scriptApp(t, "quiet", "echo ok\n")
+	none.IsTest = true
+	defer supervisedEnv(app, none)()
+	noteTestCounts(&envMap.Instances[0].Apps[2], &testCounts{Passed: 7})
+
+	dir := filepath.Join(appDir(&envMap.Instances[0].Apps[1]), "results")
+	os.Mkdir(dir, 0755)
+	for name, content := range map[string]string{
+		"api.xml":     junitXML,
+		"cli.tap":     tapOutput,
+		"smoke.json":  `{"Passed": 5, "Failed": 0, "Skipped": 1}`,
+		"notes.txt":   "ignored",
+		"broken.json": "{",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	collectResults()
+	// api: 1+5 passed, 2+2 failed, 1+3 skipped; cli: 1, 1, 2; smoke: 5, 0, 1; quiet: 7, 0, 0
+	if got, want := *testTotals(), (testCounts{Passed: 19, Failed: 5, Skipped: 7}); got != want {
+		t.Errorf("expected totals %+v, got %+v", want, got)
+	}
+
+	report := filepath.Join(t.TempDir(), "junit.xml")
+	if err := writeReport(report); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	suites, err := parseJUnit(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	var total testCounts
+	for i := range suites {
+		names = append(names, suites[i].Name)
+		total.add(suites[i].counts())
+	}
+	if s := strings.Join(names, " "); s != "tests.api tests.totals-only tests.cli tests.smoke quiet" {
+		t.Errorf("unexpected suites in the report: %s", s)
+	}
+	if total != *testTotals() {
+		t.Errorf("report totals %+v do not match %+v", total, *testTotals())
+	}
+}
+
+func TestNoResultsNoReport(t *testing.T) {
+	defer supervisedEnv(appDescr{UID: "svc", Name: "svc"})()
+	if _, err := os.Stat(defaultReport); err == nil {
+		t.Skipf("%s is already there", defaultReport)
+	}
+	<-StateResults(context.Background())
+	if _, err := os.Stat(defaultReport); err == nil {
+		os.Remove(defaultReport)
+		t.Errorf("a report was written although there were no results")
+	}
+
+	envMap.Report = filepath.Join(t.TempDir(), "empty.xml")
+	<-StateResults(context.Background())
+	if _, err := os.Stat(envMap.Report); err != nil {
+		t.Errorf("expected the report that was asked for: %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+//  What tgo is doing.
+//
+//  The orchestrator records the state it is in and every activation
+//  records its outcome here, so that the heartbeat and anything else
+//  that reports on a live run can say what is going on without
+//  reaching into the state handlers. The metrics and events are fed from
+//  here too.
+
+// appStateNames are the names of the app states, indexed by state
+var appStateNames = []string{"UNINITIALIZED", "INIT", "READY", "TEST", "DONE", "TERM", "BLOCKED"}
+
+// appStateName returns the name of an app state
+func appStateName(s int) string {
+	if s >= 0 && s < len(appStateNames) {
+		return appStateNames[s]
+	}
+	return "UNKNOWN"
+}
+
+// appStateLock guards the State of every app. The orchestrator moves apps
+// from state to state while the heartbeat and the status API report them.
+var appStateLock sync.Mutex
+
+// appState returns the state of an app
+func appState(a *appDescr) int {
+	appStateLock.Lock()
+	defer appStateLock.Unlock()
+	return a.State
+}
+
+// setAppState moves an app to state s
+func setAppState(a *appDescr, s int) {
+	appStateLock.Lock()
+	a.State = s
+	appStateLock.Unlock()
+}
+
+// envSnapshot returns a copy of envMap whose app states can be read
+// without holding appStateLock
+func envSnapshot() envDescr {
+	appStateLock.Lock()
+	defer appStateLock.Unlock()
+	e := envMap
+	e.Instances = make([]instDescr, len(envMap.Instances))
+	for i, inst := range envMap.Instances {
+		inst.Apps = append([]appDescr(nil), inst.Apps...)
+		e.Instances[i] = inst
+	}
+	return e
+}
+
+// activationRecord is the outcome of an activation command
+type activationRecord struct {
+	Cmd      string
+	Reply    string
+	Err      string `json:",omitempty"`
+	Time     time.Time
+	Duration time.Duration
+}
+
+// runInfo is what tgo is doing
+var runInfo = struct {
+	sync.Mutex
+	started  time.Time                   // when tgo started
+	state    string                      // the state the orchestrator is in
+	entered  time.Time                   // when it entered that state
+	last     map[string]activationRecord // the latest activation for each app, by UID
+	latest   string                      // UID of the app activated most recently
+	restarts map[string]int              // the number of times each app has been restarted, by UID
+}{started: time.Now(), last: make(map[string]activationRecord), restarts: make(map[string]int)}
+
+// setCurrentState records that the orchestrator has entered the named state
+func setCurrentState(name string) {
+	runInfo.Lock()
+	left, d := runInfo.state, time.Since(runInfo.entered)
+	runInfo.state, runInfo.entered = name, time.Now()
+	runInfo.Unlock()
+	metricState(left, d, name)
+	if left != "" {
+		publish(event{Type: evStateExited, State: left, Duration: d})
+	}
+	publish(event{Type: evStateEntered, State: name})
+}
+
+// currentState returns the state the orchestrator is in and when it entered it
+func currentState() (string, time.Time) {
+	runInfo.Lock()
+	defer runInfo.Unlock()
+	return runInfo.state, runInfo.entered
+}
+
+// noteActivation records the outcome of an activation command
+func noteActivation(a *appDescr, cmd, reply string, err error, d time.Duration) {
+	r := activationRecord{Cmd: cmd, Reply: strings.TrimRight(reply, "\n\r"), Time: time.Now(), Duration: d}
+	if err != nil {
+		r.Err = err.Error()
+	}
+	runInfo.Lock()
+	runInfo.last[a.UID] = r
+	runInfo.latest = a.UID
+	runInfo.Unlock()
+	metricActivation(a.UID, cmd, reply, err, d)
+	publish(event{Type: evActivationResult, UID: a.UID, Cmd: cmd, Reply: r.Reply, Err: r.Err, Duration: d})
+}
+
+// lastActivation returns the latest activation of the app with the
+// supplied UID, if it has been activated
+func lastActivation(uid string) (activationRecord, bool) {
+	runInfo.Lock()
+	defer runInfo.Unlock()
+	r, ok := runInfo.last[uid]
+	return r, ok
+}
+
+// latestActivation returns the UID of the app activated most recently and
+// the outcome. uid is "" if there have been no activations.
+func latestActivation() (uid string, r activationRecord) {
+	runInfo.Lock()
+	defer runInfo.Unlock()
+	return runInfo.latest, runInfo.last[runInfo.latest]
+}
+
+// noteRestart records that the app with the supplied UID was restarted
+// and why
+func noteRestart(uid, reason string) {
+	runInfo.Lock()
+	runInfo.restarts[uid]++
+	runInfo.Unlock()
+	publish(event{Type: evRestart, UID: uid, Reason: reason})
+}
+
+// restartCount returns the number of times the app has been restarted
+func restartCount(uid string) int {
+	runInfo.Lock()
+	defer runInfo.Unlock()
+	return runInfo.restarts[uid]
+}
+
+// uptime returns how long tgo has been running
+func uptime() time.Duration {
+	runInfo.Lock()
+	defer runInfo.Unlock()
+	return time.Since(runInfo.started)
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"os"
 	"os/exec"
-	"regexp"
+	"path/filepath"
 	"strings"
 	"time"
 )
@@ -20,21 +23,33 @@ const (
 	STATETesting
 	STATEDone
 	STATETerm
+	STATEBlocked // terminal failure, tgo cannot proceed
 )
 
 const (
 	cmdTESTNOW = iota // tells Tgo to initiate testing
-	cmdSTOP
+	cmdSTOP           // stop all apps gracefully and exit
+	cmdABORT          // stop all apps immediately and exit
+	cmdSIGNAL         // tgo received SIGINT or SIGTERM, same as cmdSTOP
 )
 
+// abortGrace is the time each app is given to stop when uhura sends ABORT
+const abortGrace = 1 * time.Second
+
 type appDescr struct {
-	UID    string
-	Name   string
-	Repo   string
-	UPort  int
-	IsTest bool
-	State  int
-	RunCmd string
+	UID       string
+	Name      string
+	Repo      string
+	UPort     int
+	IsTest    bool
+	State     int
+	RunCmd    string
+	DependsOn []string      // UIDs of apps in this instance that must be ready before this app is started
+	Timeouts  *timeoutDescr // optional, overrides for this app
+	Health    *healthDescr  // optional, checks used instead of 'activate.sh ready'
+	Restart   *restartDescr // optional, what to do if the app stops during the tests
+	Results   string        // optional, directory in the app's directory where tests leave results
+	Artifacts []string      // optional, globs of files in the app's directory to upload after the tests
 }
 
 type instDescr struct {
@@ -45,13 +60,25 @@ type instDescr struct {
 }
 
 type envDescr struct {
-	EnvName   string
-	UhuraURL  string
-	UhuraPort int
-	ThisInst  int
-	ThisApp   int // not in uhura's def. This is tgo's index within the Apps array
-	State     int
-	Instances []instDescr
+	EnvName     string
+	UhuraURL    string
+	UhuraPort   int
+	ThisInst    int
+	ThisApp     int // not in uhura's def. This is tgo's index within the Apps array
+	State       int
+	Instances   []instDescr
+	Timeouts    *timeoutDescr   // optional, overrides the default timeouts
+	Retry       *retryDescr     // optional, overrides the default PostStatus retries
+	States      []stateDescr    // optional, states to add to the standard lifecycle
+	Workers     int             // optional, max activation scripts run at once
+	Logs        *logDescr       // optional, overrides where app output is written
+	Report      string          // optional, file for the merged JUnit report
+	ArtifactURL string          // optional, where artifact bundles are uploaded
+	Heartbeat   int             // optional, seconds between heartbeats sent to uhura, 0 for none
+	Auth        *authDescr      // optional, the secret used to sign requests to and from uhura
+	TLS         *tlsDescr       // optional, certificates for TLS with uhura
+	Protocol    int             // optional, highest protocol version to offer uhura, default 1
+	Transport   *transportDescr // optional, how status messages are delivered, default HTTP
 }
 
 var envMap envDescr
@@ -75,388 +102,776 @@ func AppsAtOrBeyondState(state int, testsonly bool) (count, possible int) {
 			continue
 		}
 		possible++ // this one contributes to the total possible
-		if envMap.Instances[envMap.ThisInst].Apps[i].State >= state {
+		if appState(&envMap.Instances[envMap.ThisInst].Apps[i]) >= state {
 			count++
 		}
 	}
 	return count, possible
 }
 
+// AppsBelowState returns the UIDs of the apps that have not yet reached the
+// requested state. It is used to tell uhura what we were waiting on.
+func AppsBelowState(state int, testsonly bool) string {
+	var uids []string
+	for i := 0; i < len(envMap.Instances[envMap.ThisInst].Apps); i++ {
+		a := &envMap.Instances[envMap.ThisInst].Apps[i]
+		if i == envMap.ThisApp || (testsonly && !a.IsTest) {
+			continue
+		}
+		if appState(a) < state {
+			uids = append(uids, a.UID)
+		}
+	}
+	return strings.Join(uids, ", ")
+}
+
+// stateError is the error returned by a state handler that cannot proceed.
+// App is the index of the app responsible, which is tgo's own index if no
+// particular app is to blame. RC is the exit code tgo will use.
+type stateError struct {
+	App    int
+	RC     int
+	Reason string
+}
+
+func (e *stateError) Error() string {
+	return e.Reason
+}
+
+// appError returns a stateError for the app at index i with exit code 1
+func appError(i int, format string, a ...interface{}) error {
+	return &stateError{App: i, RC: 1, Reason: fmt.Sprintf(format, a...)}
+}
+
+// stateResult is what a state handler sends the orchestrator when it has
+// finished. Code is informational. Err is nil if the state completed, the
+// context's error if it was cancelled or timed out, or a *stateError if
+// it could not proceed.
+type stateResult struct {
+	Code int
+	Err  error
+}
+
+// newStatusMsg returns the status message for the app at index iapp
+func newStatusMsg(iapp int, state, reason string) StatusMsg {
+	return StatusMsg{
+		State:    state,
+		InstName: envMap.Instances[envMap.ThisInst].InstName,
+		UID:      envMap.Instances[envMap.ThisInst].Apps[iapp].UID,
+		Tstamp:   protoTimestamp(),
+		Reason:   reason,
+	}
+}
+
 // PostStatusAndGetReply does exactly as the title suggests.
-// TODO: probably need to add some error handling for common
-// http error types where we can retry.
-func PostStatusAndGetReply(iapp int, state string, r *StatusReply) {
-	s := StatusMsg{state,
-		envMap.Instances[envMap.ThisInst].InstName,
-		envMap.Instances[envMap.ThisInst].Apps[iapp].UID,
-		time.Now().Format(time.RFC822)}
-
-	rc, e := PostStatus(&s, r)
+// PostStatus retries transient errors, so if we get an error back
+// here uhura is unreachable.
+func PostStatusAndGetReply(ctx context.Context, iapp int, state string, r *StatusReply) error {
+	s := newStatusMsg(iapp, state, "")
+	return PostMsgAndGetReply(ctx, iapp, &s, r)
+}
+
+// PostMsgAndGetReply is PostStatusAndGetReply for a status message the
+// caller has built.
+func PostMsgAndGetReply(ctx context.Context, iapp int, s *StatusMsg, r *StatusReply) error {
+	state := s.State
+	rc, e := PostStatusCtx(ctx, s, r)
 	if nil != e {
 		ulog("PostStatus returned error:  %v\n", e)
-		os.Exit(5)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return &stateError{App: iapp, RC: 5, Reason: e.Error()}
 	}
 
 	if rc != 200 {
 		ulog("Bad HTTP response code: %d\n", rc)
-		os.Exit(3)
+		return &stateError{App: iapp, RC: 3, Reason: fmt.Sprintf("bad HTTP response code %d to %s status", rc, state)}
 	}
 
 	if r.ReplyCode != RespOK {
 		ulog("Uhura is not happy:  response to status: %d\n", r.ReplyCode)
 		dPrintStatusReply(r)
-		os.Exit(4)
+		return &stateError{App: iapp, RC: 4, Reason: fmt.Sprintf("uhura replied %d to %s status", r.ReplyCode, state)}
+	}
+	return nil
+}
+
+// finalPostTimeout is the most time, in seconds, PostFinalStatus allows
+// for its one attempt
+const finalPostTimeout = 2
+
+// PostFinalStatus posts a status for the app at index iapp that does not
+// require any further action from tgo, such as BLOCKED or TERM. Since this
+// is used on the way out, when uhura may already have shut down, it makes
+// a single attempt with a short timeout. Errors are logged and otherwise
+// ignored.
+func PostFinalStatus(iapp int, state, reason string) {
+	s := newStatusMsg(iapp, state, reason)
+	var r StatusReply
+	rs := retrySettings()
+	rs.Attempts = 1
+	if rs.Timeout > finalPostTimeout {
+		rs.Timeout = finalPostTimeout
+	}
+	rc, e := postStatus(context.Background(), &s, &r, rs)
+	switch {
+	case e != nil:
+		ulog("PostFinalStatus: could not post %s status for %s:  %v\n", state, s.UID, e)
+	case rc != 200:
+		ulog("PostFinalStatus: bad HTTP response code posting %s status for %s: %d\n", state, s.UID, rc)
+	case r.ReplyCode != RespOK:
+		ulog("PostFinalStatus: uhura replied %d to %s status for %s\n", r.ReplyCode, state, s.UID)
+	}
+}
+
+// PostFailure tells uhura that the app at index iapp is BLOCKED and why.
+func PostFailure(iapp int, reason string) {
+	PostFinalStatus(iapp, "BLOCKED", reason)
+}
+
+// fail is called when tgo cannot continue. It marks the app responsible and
+// tgo itself as BLOCKED, reports the reason to uhura, and stops all the apps.
+// It returns the code with which tgo should exit.
+func fail(err error) int {
+	se, ok := err.(*stateError)
+	if !ok {
+		se = &stateError{App: envMap.ThisApp, RC: 1, Reason: err.Error()}
 	}
+	ulog("*** FAILURE: %s\n", se.Reason)
+	apps := envMap.Instances[envMap.ThisInst].Apps
+	if se.RC != 5 { // if uhura is unreachable there's no one to tell
+		uploadArtifacts("BLOCKED: " + se.Reason) // before the apps are stopped
+		setAppState(&apps[se.App], STATEBlocked)
+		PostFailure(se.App, se.Reason)
+		if se.App != envMap.ThisApp {
+			setAppState(&apps[envMap.ThisApp], STATEBlocked)
+			PostFailure(envMap.ThisApp, fmt.Sprintf("%s: %s", apps[se.App].UID, se.Reason))
+		}
+	}
+	stopAllApps(0) // don't leave anything running for the next run on this instance
+	return se.RC
 }
 
 // activateCmd execs the supplied instance (only instance index is provided) with the
-// supplied cmd argument. It returns the cmd output as a string.
-func activateCmd(i int, cmd string) string {
+// supplied cmd argument. It returns the cmd output as a string. Apps that have
+// a RunCmd are supervised directly by tgo rather than through activate.sh.
+// Apps that have health checks are asked if they are ready by running them.
+// If ctx is cancelled the activation script is killed. The outcome is
+// recorded as the app's latest activation.
+func activateCmd(ctx context.Context, i int, cmd string) (string, error) {
+	publish(event{Type: evActivationStart, UID: envMap.Instances[envMap.ThisInst].Apps[i].UID, Cmd: cmd})
+	start := time.Now()
+	out, err := activate(ctx, i, cmd)
+	noteActivation(&envMap.Instances[envMap.ThisInst].Apps[i], cmd, out, err, time.Since(start))
+	return out, err
+}
+
+// activate runs the activation command for activateCmd
+func activate(ctx context.Context, i int, cmd string) (string, error) {
 	a := &envMap.Instances[envMap.ThisInst].Apps[i] // convenient handle for the app we're activating
-	dirname := fmt.Sprintf("../%s", a.Name)
-	if err := os.Chdir(dirname); err != nil {
-		ulog("could not cd to %s:  %v\n", dirname, err)
+	if cmd == "ready" && a.Health != nil {
+		return checkHealth(ctx, i)
+	}
+	if a.RunCmd != "" {
+		return superviseCmd(i, cmd), nil
 	}
+	out, err := runActivate(ctx, i, cmd)
+	if err != nil {
+		if ctx.Err() != nil {
+			return out, ctx.Err()
+		}
+		return out, appError(i, "%s/activate.sh %s failed: %v%s", appDir(a), cmd, err, stderrTail(a))
+	}
+	return out, nil
+}
 
+// runActivate runs the app's activate.sh script with the supplied cmd argument.
+// If ctx is cancelled or reaches its deadline before the script completes,
+// the script is killed.
+// The script runs in the app's directory. tgo's own working directory is
+// never changed, so apps can be activated concurrently. The script's
+// stdout and stderr are copied to the app's log files.
+func runActivate(ctx context.Context, i int, cmd string) (string, error) {
+	a := &envMap.Instances[envMap.ThisInst].Apps[i]
+	dirname := appDir(a)
 	ulog("os.Stat(%s/activate.sh)\n", dirname)
-	if _, err := os.Stat("activate.sh"); os.IsNotExist(err) {
-		// TODO: Report error to uhura
+	if _, err := os.Stat(filepath.Join(dirname, "activate.sh")); os.IsNotExist(err) {
 		ulog("no activation script in: %s\n", dirname)
-		return "error - no activation script"
+		return "error - no activation script", nil
 	}
-	out, err := exec.Command("./activate.sh", cmd).Output()
-	if err != nil {
-		log.Fatal(err)
+	var stdout bytes.Buffer
+	out, errw := getAppOutput(a).begin("activate.sh " + cmd)
+	c := exec.CommandContext(ctx, "./activate.sh", cmd)
+	c.Dir = dirname
+	c.Stdout = io.MultiWriter(&stdout, out)
+	c.Stderr = errw
+	c.WaitDelay = time.Second // don't wait on anything the script left running with our stdout or stderr
+	c.SysProcAttr = newGroup()
+	err := c.Run()
+	if errors.Is(err, exec.ErrWaitDelay) {
+		err = nil
+	}
+	if c.Process != nil && (cmd == "start" || cmd == "test") {
+		setAppGroup(a.UID, c.Process.Pid) // what the script started runs in its group
 	}
-	os.Chdir("../tgo")
-	return string(out)
+	return stdout.String(), err
 }
 
 // actionAllApps calls the activate.sh script for all Apps (excluding tgo itself)
 // If the result is "OK" then it automatically sends uhura the status for each app.
-func actionAllApps(actCmd string, expect string, stateval int, status string) {
+// The scripts are run concurrently; their replies are handled in array order.
+func actionAllApps(ctx context.Context, actCmd string, expect string, stateval int, status string) error {
 	me := envMap.ThisApp
-	var errResult = regexp.MustCompile(`^error .*`)
+	var idx []int
 	for i := 0; i < len(envMap.Instances[envMap.ThisInst].Apps); i++ {
 		a := &envMap.Instances[envMap.ThisInst].Apps[i] // shorter notation
-		if i == me || a.State >= stateval {             // skip tgo, and any app already at or beyond reqested state
+		if i == me || appState(a) >= stateval {         // skip tgo, and any app already at or beyond reqested state
 			continue
 		}
-		filename := fmt.Sprintf("../%s/activate.sh", a.Name) // this is the activation script we'll be hitting
-		retval := activateCmd(i, actCmd)                     // run the command
-		lower := strings.ToLower(retval)                     // see how it went
-		lower = strings.TrimRight(lower, "\n\r")             // remove CR, LF
-		switch {
-		case lower == expect: // if it started ok...
-			ulog("%s %s returns %s\n", filename, actCmd, expect) // update the log...
-			a.State = stateval                                   // and move to the Init state
-			var r StatusReply
-			PostStatusAndGetReply(i, status, &r)
-			// TODO: look at this reply and act on it if necessary
-		case errResult.MatchString(lower): // regexp:  begins with error
-			ulog("%s returns error: %s\n", filename, retval[6:])
-			// TODO: if retryable... keep going, if not, report back BLOCKED
-		default:
-			ulog("*** ERROR: unexpected reply from %s: %s\n", filename, retval)
+		idx = append(idx, i)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	res := activateApps(ctx, idx, actCmd) // run the command on all of them at once
+	for n, i := range idx {
+		if res[n].err != nil {
+			return res[n].err
+		}
+		if _, err := checkReply(ctx, i, actCmd, expect, stateval, status, res[n].reply); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkReply handles the reply retval from the app at index i to the
+// activation command actCmd. If it is the expected value, the app is moved
+// to stateval and uhura is sent the status. It returns true if the reply
+// was the expected value, and an error if the reply was a fatal error.
+func checkReply(ctx context.Context, i int, actCmd string, expect string, stateval int, status string, retval string) (bool, error) {
+	a := &envMap.Instances[envMap.ThisInst].Apps[i]      // shorter notation
+	filename := fmt.Sprintf("../%s/activate.sh", a.Name) // this is the activation script we'll be hitting
+	rep := parseReply(retval)                            // see how it went
+	logProgress(filename, actCmd, &rep)
+	switch {
+	case rep.Status == expect: // if it started ok...
+		ulog("%s %s returns %s\n", filename, actCmd, expect) // update the log...
+		setAppState(a, stateval)                             // and move to the Init state
+		var r StatusReply
+		if err := PostStatusAndGetReply(ctx, i, status, &r); err != nil {
+			return true, err
 		}
+		return true, nil
+	case rep.Status == "error":
+		ulog("%s returns error: %s\n", filename, rep.Message)
+		return false, replyError(i, actCmd, &rep) // if it's retryable we'll ask again
+	default:
+		ulog("*** ERROR: unexpected reply from %s: %s\n", filename, retval)
+	}
+	return false, nil
+}
+
+// logProgress logs any progress or test counts in an activation reply
+func logProgress(filename, actCmd string, rep *actReply) {
+	if rep.Progress > 0 {
+		ulog("%s %s: %d%% complete\n", filename, actCmd, rep.Progress)
+	}
+	if t := rep.Tests; t != nil {
+		ulog("%s %s: %d passed, %d failed, %d skipped\n", filename, actCmd, t.Passed, t.Failed, t.Skipped)
 	}
 }
 
-// StateInit puts TGO into the INIT state.
-// 'activate.sh start' all apps
+// pause waits for the supplied duration. It returns the context's error
+// if ctx is cancelled or reaches its deadline first.
+func pause(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// StateUnknown puts TGO into the INIT state.
+// 'activate.sh start' all apps, in dependency order
 // set all their states to STATEInitializing
-func StateUnknown() chan int {
-	c := make(chan int)
+func StateUnknown(ctx context.Context) <-chan stateResult {
+	c := make(chan stateResult, 1)
 	go func() {
 		ulog("Entering StateUnknown\n")
 		ulog("Starting all apps\n")
-		actionAllApps("start", "ok", STATEInitializing, "INIT")
-		c <- 1                                  // we've started each app. we're done
-		ulog("StateUnknown: exiting %d\n", <-c) // no cleanup work to do, just ack and exit
+		err := startApps(ctx)
+		c <- stateResult{1, err} // we've started each app. we're done
+		ulog("StateUnknown: exiting 0\n")
 	}()
-
 	return c
 }
 
 // StateInit sees TGO through the init state.
 // 'activate.sh ready' all apps.
 // For each app that's ready, move it to the INIT state.
-// If all apps are not in the ready state, it will wait 15 seconds and try again.
-// It will stay in this mode forever until all the apps are in the init state or beyond
-func StateInit() chan int {
-	c := make(chan int)
+// If all apps are not in the ready state, it will wait and try again.
+// It will stay in this mode until all the apps are in the init state or beyond,
+// or until ctx is cancelled or times out.
+func StateInit(ctx context.Context) <-chan stateResult {
+	c := make(chan stateResult, 1)
 	go func() {
-		envMap.Instances[envMap.ThisInst].Apps[envMap.ThisApp].State = STATEReady // tgo is READY, just waiting on apps now
-		for {
-			actionAllApps("ready", "ok", STATEInitializing, "INIT")           // activate.sh ready
-			count, possible := AppsAtOrBeyondState(STATEInitializing, false)  // how many are ready or init
-			ulog("%d of %d apps are in STATEInitializing\n", count, possible) // log results
-			if count == possible {                                            // if all are at least in the init state move on
-				c <- 0 // tell StateOrchestrator we're done
-				break  // bust out of the loop
-			}
-			time.Sleep(time.Duration(15 * time.Second)) // if any of the apps are still UNKNOWN wait and try again
-		}
-		ulog("StateInit: exiting %d\n", <-c) //do any cleanup work before this point
+		setAppState(&envMap.Instances[envMap.ThisInst].Apps[envMap.ThisApp], STATEReady) // tgo is READY, just waiting on apps now
+		c <- stateResult{0, pollAllApps(ctx, "INIT", STATEInitializing, "STATEInitializing")}
+		ulog("StateInit: exiting 0\n")
 	}()
 	return c
 }
 
-// 'activate.sh ready' all apps.  They will probably already be in the READY state,
+// pollAllApps calls 'activate.sh ready' for all apps until they have all
+// reached stateval, waiting the state's poll interval between attempts.
+func pollAllApps(ctx context.Context, status string, stateval int, stateName string) error {
+	for {
+		if err := actionAllApps(ctx, "ready", "ok", stateval, status); err != nil { // activate.sh ready
+			return err
+		}
+		count, possible := AppsAtOrBeyondState(stateval, false)       // how many are ready
+		ulog("%d of %d apps are in %s\n", count, possible, stateName) // log results
+		if count == possible {                                        // if all are at least in the requested state move on
+			return nil
+		}
+		if err := pause(ctx, pollInterval(status)); err != nil { // if any of the apps are not there yet wait and try again
+			return err
+		}
+	}
+}
+
+// StateReady calls 'activate.sh ready' on all apps.  They will probably already be in the READY state,
 // but this is the final check. If there were slow starters during the INIT phase
 // they may need the time.
-func StateReady() chan int {
-	c := make(chan int)
+func StateReady(ctx context.Context) <-chan stateResult {
+	c := make(chan stateResult, 1)
 	go func() {
 		ulog("Entering StateReady\n")
-		for {
-			actionAllApps("ready", "ok", STATEReady, "READY") // activate.sh ready
-			count, possible := AppsAtOrBeyondState(STATEReady, false)
-			ulog("%d of %d apps are in STATETesting\n", count, possible)
-			if count == possible {
-				c <- 0
-				break
-			}
-			time.Sleep(time.Duration(15 * time.Second))
-		}
-		ulog("StateReady: exiting %d\n", <-c) //do any cleanup work before this point
+		c <- stateResult{0, pollAllApps(ctx, "READY", STATEReady, "STATETesting")}
+		ulog("StateReady: exiting 0\n")
 	}()
 	return c
 }
 
 // StateTest puts TGO into the TEST state.
-func StateTest() chan int {
-	c := make(chan int)
+func StateTest(ctx context.Context) <-chan stateResult {
+	c := make(chan stateResult, 1)
 	go func() {
 		ulog("Entering StateTest\n")
-		var errResult = regexp.MustCompile(`^error .*`)
-		var a *appDescr
-		me := envMap.ThisApp
-
-		// Start all tests...
-		for i := 0; i < len(envMap.Instances[envMap.ThisInst].Apps); i++ {
-			if i == me {
-				continue
+		c <- stateResult{0, runTests(ctx)}
+		ulog("StateTest: exiting 0\n")
+	}()
+	return c
+}
+
+// testApps returns the indeces of the test apps
+func testApps() []int {
+	var idx []int
+	for i := 0; i < len(envMap.Instances[envMap.ThisInst].Apps); i++ {
+		if i != envMap.ThisApp && envMap.Instances[envMap.ThisInst].Apps[i].IsTest {
+			idx = append(idx, i)
+		}
+	}
+	return idx
+}
+
+// testReply handles the reply retval from the test app at index i to the
+// test command. It returns true if the test command should be repeated,
+// and an error if the reply was a fatal error.
+func testReply(ctx context.Context, i int, retval string) (bool, error) {
+	var r StatusReply
+	a := &envMap.Instances[envMap.ThisInst].Apps[i]
+	filename := fmt.Sprintf("../%s/activate.sh", a.Name) // this is the activation script we'll be hitting
+	rep := parseReply(retval)
+	logProgress(filename, "test", &rep)
+	setAppState(a, STATETesting)
+	switch {
+	case rep.Status == "ok":
+		ulog("%s returns OK\n", filename)
+		if err := PostStatusAndGetReply(ctx, i, "TEST", &r); err != nil {
+			return false, err
+		}
+
+	case rep.Status == "error":
+		ulog("%s returns error: %s\n", filename, rep.Message)
+		if rep.errClass() == errRetryable {
+			ulog("%s: will retry the test command\n", a.UID)
+			setAppState(a, STATEReady)
+			return true, nil
+		}
+		return false, replyError(i, "test", &rep)
+
+	default:
+		ulog("*** ERROR: unexpected reply to 'test' command from %s: %s\n", filename, retval)
+	}
+	return false, nil
+}
+
+// runTests starts all the tests, then waits for them to finish. The test
+// and teststatus scripts are run concurrently for all the test apps. Apps
+// with a restart policy are restarted if they stop before the tests finish.
+func runTests(ctx context.Context) error {
+	var a *appDescr
+	var r StatusReply
+	me := envMap.ThisApp
+
+	// Start all tests...
+	tests := testApps()
+	started := map[int]activation{}
+	for n, res := range activateApps(ctx, tests, "test") {
+		started[tests[n]] = res
+	}
+	retest := map[int]bool{} // tests whose test command will be repeated
+	for i := 0; i < len(envMap.Instances[envMap.ThisInst].Apps); i++ {
+		if i == me {
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		a = &envMap.Instances[envMap.ThisInst].Apps[i]
+		if a.IsTest {
+			if started[i].err != nil {
+				return started[i].err
+			}
+			again, err := testReply(ctx, i, started[i].reply)
+			if err != nil {
+				return err
+			}
+			retest[i] = again
+		} else {
+			setAppState(a, STATETesting)
+			if err := PostStatusAndGetReply(ctx, i, "TEST", &r); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Restart any apps that stop while the tests are running
+	crashes, stopWatching := watchApps(ctx)
+	defer stopWatching()
+
+	// This tgo app (me) can move the DONE state. Now just wait on the tests to finish
+	setAppState(&envMap.Instances[envMap.ThisInst].Apps[me], STATEDone)
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		select {
+		case err := <-crashes:
+			return err
+		default:
+		}
+		var restart, running []int
+		for _, i := range tests {
+			if retest[i] {
+				restart = append(restart, i)
+			} else {
+				running = append(running, i)
+			}
+		}
+		for n, res := range activateApps(ctx, restart, "test") {
+			if res.err != nil {
+				return res.err
+			}
+			again, err := testReply(ctx, restart[n], res.reply)
+			if err != nil {
+				return err
+			}
+			retest[restart[n]] = again
+		}
+
+		polled := activateApps(ctx, running, "teststatus")
+		for n, i := range running {
+			if ctx.Err() != nil {
+				return ctx.Err()
 			}
 			a = &envMap.Instances[envMap.ThisInst].Apps[i]
-			if a.IsTest {
-				filename := fmt.Sprintf("../%s/activate.sh", a.Name) // this is the activation script we'll be hitting
-				retval := activateCmd(i, "test")
-				lower := strings.ToLower(retval)
-				lower = strings.TrimRight(lower, "\n\r") // remove CR, LF
-				a.State = STATETesting
-				switch {
-				case lower == "ok":
-					ulog("%s returns OK\n", filename)
-					a.State = STATETesting
-					var r StatusReply
-					PostStatusAndGetReply(i, "TEST", &r)
-
-				case errResult.MatchString(lower): // regexp:  begins with error
-					ulog("%s returns error: %s\n", filename, retval[6:])
-					// TODO: if retryable... keep going, if not, report back BLOCKED
-
-				default:
-					ulog("*** ERROR: unexpected reply to 'test' command from %s: %s\n", filename, retval)
+			filename := fmt.Sprintf("../%s/activate.sh", a.Name) // this is the activation script we'll be hitting
+			retval, err := polled[n].reply, polled[n].err
+			if err != nil {
+				return err
+			}
+			rep := parseReply(retval)
+			logProgress(filename, "teststatus", &rep)
+			noteTestCounts(a, rep.Tests)
+			switch {
+			case rep.Status == "done":
+				ulog("%s returns DONE\n", filename)
+				setAppState(a, STATEDone)
+				if err := PostStatusAndGetReply(ctx, i, "DONE", &r); err != nil {
+					return err
 				}
-			} else {
-				a.State = STATETesting
-				var r StatusReply
-				PostStatusAndGetReply(i, "TEST", &r)
+
+			case rep.Status == "testing":
+				// nothing to do, let it keep running
+
+			case rep.Status == "error":
+				ulog("%s returns error: %s\n", filename, rep.Message)
+				if err := replyError(i, "teststatus", &rep); err != nil {
+					return err
+				}
+
+			default:
+				ulog("*** ERROR: unexpected reply to 'teststatus' command from %s: %s\n", filename, retval)
 			}
 		}
 
-		// This tgo app (me) can move the DONE state. Now just wait on the tests to finish
-		envMap.Instances[envMap.ThisInst].Apps[me].State = STATEDone
-		for {
+		count, possible := AppsAtOrBeyondState(STATEDone, true)
+		ulog("%d of %d apps are in STATEDone\n", count, possible)
+		if count == possible {
+			// mark the apps as in the DONE state now...
 			for i := 0; i < len(envMap.Instances[envMap.ThisInst].Apps); i++ {
 				if i == me {
 					continue
 				}
 				a = &envMap.Instances[envMap.ThisInst].Apps[i]
-				if a.IsTest {
-					filename := fmt.Sprintf("../%s/activate.sh", a.Name) // this is the activation script we'll be hitting
-					retval := activateCmd(i, "teststatus")
-					lower := strings.ToLower(retval)
-					lower = strings.TrimRight(lower, "\n\r") // remove CR, LF
-					switch {
-					case lower == "done":
-						ulog("%s returns DONE\n", filename)
-						a.State = STATEDone // replace this statement with the real code
-						var r StatusReply
-						PostStatusAndGetReply(i, "DONE", &r)
-
-					case lower == "testing":
-						// nothing to do, let it keep running
-
-					case errResult.MatchString(lower): // regexp:  begins with error
-						ulog("%s returns error: %s\n", filename, retval[6:])
-						// TODO: if retryable... keep going, if not, report back BLOCKED
-
-					default:
-						ulog("*** ERROR: unexpected reply to 'teststatus' command from %s: %s\n", filename, retval)
+				if !a.IsTest {
+					setAppState(a, STATEDone)
+					if err := PostStatusAndGetReply(ctx, i, "DONE", &r); err != nil {
+						return err
 					}
 				}
 			}
+			return nil
+		}
+		if err := pause(ctx, pollInterval("TEST")); err != nil {
+			return err
+		}
+	}
+}
 
-			count, possible := AppsAtOrBeyondState(STATEDone, true)
-			ulog("%d of %d apps are in STATEDone\n", count, possible)
-			if count == possible {
-				// mark the apps as in the DONE state now...
-				for i := 0; i < len(envMap.Instances[envMap.ThisInst].Apps); i++ {
-					if i == me {
-						continue
-					}
-					a = &envMap.Instances[envMap.ThisInst].Apps[i]
-					if !a.IsTest {
-						a.State = STATEDone
-						var r StatusReply
-						PostStatusAndGetReply(i, "DONE", &r)
-					}
-				}
-				c <- 0
-				break
+// StateTestNow waits for uhura to tell us to begin testing.
+func StateTestNow(ctx context.Context) <-chan stateResult {
+	c := make(chan stateResult, 1)
+	go func() {
+		ulog("Orchestrator: READY TO TRANSITION TO TEST, read channel Tgo.UhuraComm\n")
+		ulog("waiting for Uhura to contact tgo\n")
+		select {
+		case i := <-Tgo.UhuraComm:
+			ulog("Orchestrator: Comms reports uhura has sent command:  %d\n", i)
+			if i == cmdTESTNOW {
+				ulog("Proceding to state TEST\n")
+			} else {
+				ulog("Unexpected response: %d.  Not sure what to do, so proceeding...\n", i)
 			}
-			time.Sleep(time.Duration(10 * time.Second))
+			c <- stateResult{0, nil}
+		case <-ctx.Done():
+			c <- stateResult{0, ctx.Err()}
 		}
-
-		//do any cleanup work here, wait for acknowledgement before we exit
-		ulog("StateTest: exiting %d\n", <-c)
 	}()
-
 	return c
 }
 
 // StateDone puts TGO into the DONE state. This may not be necessary
-func StateDone() {
-	// nothing to do at the moment
+// as there is nothing to do once DONE has been posted to uhura.
+func StateDone(ctx context.Context) <-chan stateResult {
+	c := make(chan stateResult, 1)
+	c <- stateResult{0, nil}
+	return c
 }
 
-// StateOrchestrator manages the states through which TGO
-// progresses. It decides when we need to switch states and makes
-// the change.
-func StateOrchestrator(alldone chan int) {
-	var r StatusReply
-	ulog("Orchestrator: StateUnknown started\n")
-	//#################################################################################
-	//   UNKNOWN
-	//#################################################################################
-	c := StateUnknown()
-	select {
-	case i := <-c:
-		ulog("Orchestrator: StateUnknown completed:  %d\n", i)
-		c <- 0 // tell the StateInit handler it's ok to exit
-	case <-time.After(30 * time.Minute):
-		ulog("Orchestrator: StateUnknown has not responded in 30 minutes. Giving up!\n")
-		// TODO:  tell uhura that startup has timed out
-		os.Exit(1)
-	}
-
-	ulog("Orchestrator: StateInit started\n")
-	//#################################################################################
-	//   INIT
-	//#################################################################################
-	c = StateInit()
-	select {
-	case i := <-c:
-		ulog("Orchestrator: StateInit completed:  %d\n", i)
-		c <- 0 // tell the StateInit handler it's ok to exit
-	case <-time.After(30 * time.Minute):
-		ulog("Orchestrator: StateInit has not responded in 30 minutes. Giving up!\n")
-		// TODO:  tell uhura that startup has timed out
-		os.Exit(1)
-	}
-
-	//#################################################################################
-	//   READY
-	// When we enter READY state, there's really
-	// nothing to do except wait for UHURA to send
-	// us a TESTNOW command. Then we start up the
-	// tests.
-	//#################################################################################
-	ulog("Orchestrator: Entering StateReady\n")
-	c = StateReady()
-
-	ulog("Orchestrator: Posted READY status to uhura. ReplyCode: %d\n", r.ReplyCode)
-	PostStatusAndGetReply(envMap.ThisApp, "READY", &r) // tell Uhura we're ready
-	ulog("Orchestrator: Calling StateReady\n")
-	ulog("Orchestrator: waiting for StateReady to reply\n")
-	select {
-	case i := <-c:
-		ulog("Orchestrator: StateReady completed:  %d\n", i)
-		c <- 0 // tell the StateInit handler it's ok to exit
-	case <-time.After(15 * time.Minute):
-		ulog("Orchestrator: StateReady has not responded in 15 minutes. Giving up!\n")
-		// TODO:  tell uhura that startup has timed out
-		os.Exit(1)
-	}
-
-	//#################################################################################
-	//   TEST
-	// Before we can begin the test mode, we need to hear back from uhura
-	// that we can begin testing.
-	//#################################################################################
-	ulog("Orchestrator: READY TO TRANSITION TO TEST, read channel Tgo.UhuraComm\n")
-	ulog("waiting for Uhura to contact tgo\n")
-	select {
-	case i := <-Tgo.UhuraComm:
-		ulog("Orchestrator: Comms reports uhura has sent command:  %d\n", i)
-		if i == cmdTESTNOW {
-			ulog("Proceding to state TEST\n")
-		} else {
-			ulog("Unexpected response: %d.  Not sure what to do, so proceeding...\n", i)
+// stopApp stops the app at index i. Supervised apps are signaled to exit
+// and killed if they have not exited within the grace period. Otherwise the
+// app's 'activate.sh stop' is called, and it is killed if it has not finished
+// within the grace period. Then anything still running in the process group
+// of the app's last start is killed, once the grace period is up. The app's
+// log files are closed once it has stopped.
+func stopApp(i int, grace time.Duration) string {
+	a := &envMap.Instances[envMap.ThisInst].Apps[i]
+	defer closeAppOutput(a)
+	if a.RunCmd != "" {
+		return stopProc(a, grace)
+	}
+	deadline := time.Now().Add(grace)
+	if pgid := takeAppGroup(a.UID); pgid != 0 {
+		defer func() { killGroup(a.UID, pgid, time.Until(deadline)) }()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	out, err := runActivate(ctx, i, "stop")
+	switch {
+	case ctx.Err() != nil:
+		return fmt.Sprintf("error activate.sh stop did not complete in %v, killed it", grace)
+	case err != nil:
+		return fmt.Sprintf("error %v", err)
+	}
+	return out
+}
+
+// stopAllApps stops every app other than tgo, in the reverse of the order
+// in which they were started, so no app is stopped before the apps that
+// depend on it. Apps that do not depend on each other are stopped at the
+// same time. Each app is given the supplied grace period to stop, or its
+// own TERM timeout if grace is 0. It returns the reasons for any apps that
+// did not stop cleanly, indexed by app.
+func stopAllApps(grace time.Duration) map[int]string {
+	fails := map[int]string{}
+	for _, wave := range stopWaves() {
+		replies := make([]string, len(wave))
+		forEachApp(wave, func(n, i int) { // the apps in a wave don't depend on each other
+			a := &envMap.Instances[envMap.ThisInst].Apps[i]
+			g := grace
+			if g == 0 {
+				g = appTimeout(a, "TERM")
+			}
+			replies[n] = stopApp(i, g)
+		})
+		for n, i := range wave {
+			a := &envMap.Instances[envMap.ThisInst].Apps[i]
+			retval := replies[n]
+			if replyIs(retval, "ok") {
+				ulog("%s stopped\n", a.UID)
+			} else {
+				ulog("*** ERROR: could not stop %s: %s\n", a.UID, retval)
+				fails[i] = strings.TrimRight(retval, "\n\r")
+			}
+			setAppState(a, STATETerm)
 		}
-		ulog("Orchestrator: TRANSITION TO TEST, writing to channel Tgo.UhuraComm\n")
-		Tgo.UhuraComm <- 0 // tell the HTTP handler it's ok to exit
-	case <-time.After(30 * time.Minute):
-		ulog("Orchestrator: We have not heard from Uhura in 30 minutes. Giving up!\n")
-		// TODO:  tell uhura that startup has timed out
-		os.Exit(1)
 	}
+	return fails
+}
 
-	PostStatusAndGetReply(envMap.ThisApp, "TEST", &r) // Tel UHURA we're moving to the TEST state
-	ulog("Posted TEST status to uhura. ReplyCode: %d\n", r.ReplyCode)
-	c = StateTest()
+// StateTerm puts TGO into the TERM state. It stops all apps and reports
+// the TERM state to uhura for each app, then for tgo itself. The grace
+// period and reason are as supplied by the caller; the normal end of a
+// run uses a grace of 0 (each app's own TERM timeout) and no reason.
+func StateTerm(grace time.Duration, reason string) {
+	ulog("Entering StateTerm\n")
+	fails := stopAllApps(grace)
+	for i := 0; i < len(envMap.Instances[envMap.ThisInst].Apps); i++ {
+		if i != envMap.ThisApp {
+			PostFinalStatus(i, "TERM", fails[i])
+		}
+	}
+	setAppState(&envMap.Instances[envMap.ThisInst].Apps[envMap.ThisApp], STATETerm)
+	PostFinalStatus(envMap.ThisApp, "TERM", reason)
+}
+
+// errStopped is returned by runState when uhura, or a signal, has told
+// tgo to stop. The command is cmdSTOP, cmdABORT, or cmdSIGNAL.
+type errStopped int
+
+func (e errStopped) Error() string {
+	switch int(e) {
+	case cmdABORT:
+		return "aborted by uhura"
+	case cmdSIGNAL:
+		return "stopped by signal"
+	}
+	return "stopped by uhura"
+}
+
+// runState runs the state s with a context that is cancelled if the
+// state's timeout expires or if tgo is told to stop. If the state can say
+// what it was waiting on, that is included in the error when it times out.
+func runState(ctx context.Context, s tgoState) error {
+	name := stateLabel(s)
+	var sctx context.Context
+	var cancel context.CancelFunc
+	if s.Timeout() > 0 {
+		sctx, cancel = context.WithTimeout(ctx, s.Timeout())
+	} else {
+		sctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+	c := s.Run(sctx)
+	var res stateResult
 	select {
-	case i := <-c:
-		ulog("Orchestrator: StateTest completed:  %d\n", i)
-		c <- 0 // tell the StateInit handler it's ok to exit
-	case <-time.After(30 * time.Minute):
-		ulog("Orchestrator: StateTest has not responded in 30 minutes. Giving up!\n")
-		// TODO:  tell uhura that startup has timed out
-		os.Exit(1)
-	}
-
-	//#################################################################################
-	//   DONE
-	//#################################################################################
-	PostStatusAndGetReply(envMap.ThisApp, "DONE", &r) // starting our state machine in the INIT state
-	ulog("Posted DONE status to uhura. ReplyCode: %d\n", r.ReplyCode)
-
-	//#################################################################################
-	//   TERM
-	//#################################################################################
-	// TODO:  call all apps and tell them to exit
-	//        this is optional because uhura will terminate all instances when it has
-	//        completed or timed out.
+	case res = <-c:
+	case cmd := <-Tgo.StopComm:
+		cancel()
+		res = <-c // the handler returns promptly once its context is cancelled
+		ulog("Orchestrator: %s halted:  %v\n", name, res.Err)
+		return errStopped(cmd)
+	}
+	ulog("Orchestrator: %s completed:  %d\n", name, res.Code)
+	if res.Err == context.DeadlineExceeded {
+		ulog("Orchestrator: %s has not responded in %v. Giving up!\n", name, s.Timeout())
+		if w, ok := s.(stateWaiter); ok {
+			return fmt.Errorf("%s timed out after %v waiting on: %s", name, s.Timeout(), w.WaitingOn())
+		}
+		return fmt.Errorf("%s timed out after %v", name, s.Timeout())
+	}
+	return res.Err
+}
 
-	ulog("StateOrchestrator exiting\n")
+// finish decides how the run ends based on the error that ended it, and
+// returns the code with which tgo should exit. A nil error is a normal
+// completion. If tgo was told to stop, the apps are stopped and reported
+// as TERM. Any other error means tgo is BLOCKED.
+func finish(err error) int {
+	if err == nil {
+		//#################################################################################
+		//   TERM
+		// Uhura will terminate the instances when it is done with them, but
+		// instances are sometimes reused. Stop everything we started so that
+		// nothing from this run is left behind for the next one.
+		//#################################################################################
+		StateTerm(0, "")
+		return 0
+	}
+	if cmd, ok := err.(errStopped); ok {
+		ulog("Orchestrator: %v\n", cmd)
+		grace := time.Duration(0)
+		if int(cmd) == cmdABORT {
+			grace = abortGrace
+		}
+		StateTerm(grace, cmd.Error())
+		return 0
+	}
+	return fail(err)
+}
 
-	alldone <- 1 // we're all done
+// StateOrchestrator manages the states through which TGO
+// progresses. It decides when we need to switch states and makes
+// the change. Uhura can send STOP or ABORT at any point, in which
+// case the state in progress is cancelled and the apps are stopped.
+// When it is all done, the orchestrator sends tgo's exit code to alldone.
+func StateOrchestrator(ctx context.Context, alldone chan int) {
+	hello(ctx) // agree on a protocol before saying anything else
+	stopHeartbeat := startHeartbeat(ctx)
+	err := orchestrate(ctx)
+	stopHeartbeat() // nothing more to say until TERM
+	rc := finish(err)
+	ulog("StateOrchestrator exiting\n")
+	alldone <- rc
+}
 
+// orchestrate moves TGO through the states in its state graph, returning
+// when they have all completed or when one of them returns an error.
+func orchestrate(ctx context.Context) error {
+	if _, err := appWaves(); err != nil { // catch dependency cycles before anything is started
+		return err
+	}
+	g, err := buildStateGraph()
+	if err != nil {
+		return err
+	}
+	for name := g.start; name != ""; name = g.successor(name) {
+		s := g.states[name]
+		setCurrentState(name)
+		if err := s.Enter(ctx); err != nil {
+			return err
+		}
+		if err := runState(ctx, s); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // InitiateStateMachine essentially pulls together the mission for this TGO instance
 // and sets it into motion.
-func InitiateStateMachine(alldone chan int) {
-	//whoAmI()
+func InitiateStateMachine(ctx context.Context, alldone chan int) {
 	ulog("I am instance %d, my name is %s, I am app index %d\n",
 		envMap.ThisInst, envMap.Instances[envMap.ThisInst].InstName, envMap.ThisApp)
 	ulog("I will listen for commands on port %d\n",
 		envMap.Instances[envMap.ThisInst].Apps[envMap.ThisApp].UPort)
-	envMap.Instances[envMap.ThisInst].Apps[envMap.ThisApp].State = STATEInitializing
-	var r StatusReply
-	go UhuraComms()                                   // handle anything that comes from uhura
-	PostStatusAndGetReply(envMap.ThisApp, "INIT", &r) // starting our state machine in the INIT state
-	go StateOrchestrator(alldone)                     // let the orchestrator handle it from here
+	setAppState(&envMap.Instances[envMap.ThisInst].Apps[envMap.ThisApp], STATEInitializing)
+	go UhuraComms()                    // handle anything that comes from uhura
+	go StateOrchestrator(ctx, alldone) // let the orchestrator handle it from here
 }
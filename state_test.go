@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeUhura starts an http server that accepts every status message and
+// records them. It points envMap at the server; the caller must Close it.
+func fakeUhura(msgs *[]StatusMsg) *httptest.Server {
+	var mu sync.Mutex
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var sm StatusMsg
+		json.NewDecoder(r.Body).Decode(&sm)
+		mu.Lock()
+		*msgs = append(*msgs, sm)
+		mu.Unlock()
+		b, _ := json.Marshal(StatusReply{Status: "OK", ReplyCode: RespOK, Timestamp: time.Now().Format(time.RFC822)})
+		fmt.Fprint(w, string(b))
+	}))
+	envMap.UhuraURL = ts.URL + "/"
+	return ts
+}
+
+func TestStopCommand(t *testing.T) {
+	defer supervisedEnv(appDescr{UID: "svc", Name: "svc", RunCmd: "sleep 30"})()
+	var msgs []StatusMsg
+	ts := fakeUhura(&msgs)
+	defer ts.Close()
+	Tgo.StopComm = make(chan int, 1)
+
+	if s := act(1, "start"); s != "ok" {
+		t.Fatalf("start: expected ok, got %q", s)
+	}
+
+	// a state handler that never completes on its own
+	var handlerErr error
+	never := func(ctx context.Context) <-chan stateResult {
+		c := make(chan stateResult, 1)
+		go func() {
+			for handlerErr == nil {
+				handlerErr = pause(ctx, 10*time.Millisecond)
+			}
+			c <- stateResult{0, handlerErr}
+		}()
+		return c
+	}
+
+	// uhura sends STOP
+	b, _ := json.Marshal(UCommand{Command: "STOP", CmdCode: cmdSTOP, Timestamp: time.Now().Format(time.RFC822)})
+	w := httptest.NewRecorder()
+	CommsHandler(w, httptest.NewRequest("POST", "/", bytes.NewBuffer(b)))
+	var r StatusReply
+	if err := json.NewDecoder(w.Body).Decode(&r); err != nil || r.ReplyCode != RespOK {
+		t.Fatalf("STOP was not accepted: %+v %v", r, err)
+	}
+
+	err := runState(context.Background(), &stdState{name: "TEST", handler: "StateTest", run: never, target: STATEDone, testsonly: true})
+	if err != errStopped(cmdSTOP) {
+		t.Fatalf("expected errStopped, got %v", err)
+	}
+	if handlerErr != context.Canceled {
+		t.Errorf("expected the handler's context to be cancelled, got %v", handlerErr)
+	}
+	if rc := finish(err); rc != 0 {
+		t.Errorf("expected exit code 0 after STOP, got %d", rc)
+	}
+	if exited, _, _ := getProc("svc").status(); !exited {
+		t.Errorf("svc is still running")
+	}
+	if len(msgs) != 2 || msgs[0].UID != "svc" || msgs[0].State != "TERM" ||
+		msgs[1].UID != "tgo0" || msgs[1].State != "TERM" || msgs[1].Reason != "stopped by uhura" {
+		t.Errorf("unexpected status messages: %+v", msgs)
+	}
+}
+
+func TestStateTimeout(t *testing.T) {
+	defer supervisedEnv(appDescr{UID: "slow", Name: "slow"})()
+	var msgs []StatusMsg
+	ts := fakeUhura(&msgs)
+	defer ts.Close()
+	envMap.Timeouts = &timeoutDescr{Init: 1}
+	Tgo.StopComm = make(chan int, 1)
+
+	start := time.Now()
+	err := runState(context.Background(), &stdState{name: "INIT", handler: "StateInit", target: STATEInitializing,
+		run: func(ctx context.Context) <-chan stateResult {
+			c := make(chan stateResult, 1)
+			go func() {
+				<-ctx.Done()
+				c <- stateResult{0, ctx.Err()}
+			}()
+			return c
+		}})
+	if d := time.Since(start); d < time.Second || d > 3*time.Second {
+		t.Errorf("expected a 1s timeout, took %v", d)
+	}
+	if err == nil || err.Error() != "StateInit timed out after 1s waiting on: slow" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rc := finish(err); rc != 1 {
+		t.Errorf("expected exit code 1, got %d", rc)
+	}
+	if len(msgs) != 1 || msgs[0].UID != "tgo0" || msgs[0].State != "BLOCKED" || msgs[0].Reason != err.Error() {
+		t.Errorf("unexpected status messages: %+v", msgs)
+	}
+}
+
+func TestStateGraph(t *testing.T) {
+	saved := envMap.States
+	defer func() { envMap.States = saved }()
+
+	envMap.States = []stateDescr{
+		{Name: "SETUP_DATA", After: "READY", Action: "setupdata"},
+		{Name: "COLLECT_ARTIFACTS", After: "TEST", Action: "collect"},
+		{Name: "WARMUP", After: "SETUP_DATA", Action: "warmup"},
+	}
+	g, err := buildStateGraph()
+	if err != nil {
+		t.Fatalf("buildStateGraph: %v", err)
+	}
+	p, _ := g.path()
+	expect := "UNKNOWN INIT READY SETUP_DATA WARMUP TESTNOW TEST COLLECT_ARTIFACTS RESULTS DONE"
+	if strings.Join(p, " ") != expect {
+		t.Errorf("expected path %s, got %v", expect, p)
+	}
+
+	var bad = [][]stateDescr{
+		{{Name: "X", After: "NOSUCHSTATE", Action: "x"}},
+		{{Name: "INIT", After: "READY", Action: "x"}},
+		{{Name: "X", After: "READY"}},
+	}
+	for i := 0; i < len(bad); i++ {
+		envMap.States = bad[i]
+		if _, err := buildStateGraph(); err == nil {
+			t.Errorf("expected an error building graph with %+v", bad[i])
+		}
+	}
+
+	// a hand-built cycle
+	g = defaultStateGraph()
+	g.next["TEST"] = "INIT"
+	if _, err := g.path(); err == nil {
+		t.Errorf("expected cycle to be detected")
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+//  The state graph.
+//
+//  The states TGO moves through are held in a registry. Each state knows
+//  how to enter itself, how to run, which state follows it, and how long
+//  it is allowed to take. The standard lifecycle is registered by default:
+//
+//      UNKNOWN -> INIT -> READY -> TESTNOW -> TEST -> RESULTS -> DONE
+//
+//  Additional states can be described in the environment descriptor and
+//  are inserted after the state they name. For example:
+//
+//      "States": [{"Name": "SETUP_DATA", "After": "READY", "Action": "setupdata"}]
+//
+//  runs 'activate.sh setupdata' for each app after READY and before TESTNOW,
+//  until every app has replied "ok".
+
+// tgoState is a state in TGO's lifecycle.
+type tgoState interface {
+	Name() string                               // the name used in the graph and reported to uhura
+	Enter(ctx context.Context) error            // called once, before Run
+	Run(ctx context.Context) <-chan stateResult // the state handler
+	Next() string                               // the state that follows this one, "" if this is the last
+	Timeout() time.Duration                     // time allowed for Run to complete, 0 for no limit
+}
+
+// stateWaiter is implemented by states that can say what they are waiting
+// on. It is used to tell uhura why a state timed out.
+type stateWaiter interface {
+	WaitingOn() string
+}
+
+// stateGraph is the registry of states and the transitions between them.
+type stateGraph struct {
+	start  string
+	states map[string]tgoState
+	next   map[string]string // transitions that override a state's Next()
+}
+
+// newStateGraph returns an empty graph that starts at the supplied state
+func newStateGraph(start string) *stateGraph {
+	return &stateGraph{start: start, states: map[string]tgoState{}, next: map[string]string{}}
+}
+
+// register adds s to the graph, replacing any state with the same name
+func (g *stateGraph) register(s tgoState) {
+	g.states[s.Name()] = s
+}
+
+// insertAfter adds s to the graph so that it follows the state named after,
+// and the state that used to follow after now follows s.
+func (g *stateGraph) insertAfter(after string, s tgoState) error {
+	if _, ok := g.states[after]; !ok {
+		return fmt.Errorf("cannot add state %s after %s: no such state", s.Name(), after)
+	}
+	if _, ok := g.states[s.Name()]; ok {
+		return fmt.Errorf("cannot add state %s: there is already a state with that name", s.Name())
+	}
+	g.register(s)
+	g.next[s.Name()] = g.successor(after)
+	g.next[after] = s.Name()
+	return nil
+}
+
+// successor returns the name of the state that follows the named state
+func (g *stateGraph) successor(name string) string {
+	if n, ok := g.next[name]; ok {
+		return n
+	}
+	return g.states[name].Next()
+}
+
+// path returns the names of the states in the order they will be run. It
+// returns an error if a transition leads to an unregistered state or if
+// the graph contains a cycle.
+func (g *stateGraph) path() ([]string, error) {
+	var p []string
+	seen := map[string]bool{}
+	for name := g.start; name != ""; name = g.successor(name) {
+		if _, ok := g.states[name]; !ok {
+			return nil, fmt.Errorf("state graph refers to unknown state %s", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("state graph has a cycle at %s", name)
+		}
+		seen[name] = true
+		p = append(p, name)
+	}
+	return p, nil
+}
+
+// stdState is a tgoState built from functions. It is used for the standard
+// lifecycle states.
+type stdState struct {
+	name      string                                       // name in the graph
+	handler   string                                       // name of the handler, used in logs
+	enter     func(ctx context.Context) error              // optional
+	run       func(ctx context.Context) <-chan stateResult // the handler
+	next      string                                       // the state that follows
+	target    int                                          // the app state every app must reach
+	testsonly bool                                         // only test apps need to reach target
+	waitMsg   string                                       // if set, what the state waits on instead of apps
+}
+
+func (s *stdState) Name() string   { return s.name }
+func (s *stdState) String() string { return s.handler }
+func (s *stdState) Next() string   { return s.next }
+
+func (s *stdState) Enter(ctx context.Context) error {
+	if s.enter == nil {
+		return nil
+	}
+	return s.enter(ctx)
+}
+
+func (s *stdState) Run(ctx context.Context) <-chan stateResult {
+	return s.run(ctx)
+}
+
+func (s *stdState) Timeout() time.Duration {
+	return stateTimeout(s.name)
+}
+
+func (s *stdState) WaitingOn() string {
+	if s.waitMsg != "" {
+		return s.waitMsg
+	}
+	return AppsBelowState(s.target, s.testsonly)
+}
+
+// stateLabel returns the name used for a state in the logs
+func stateLabel(s tgoState) string {
+	if st, ok := s.(fmt.Stringer); ok {
+		return st.String()
+	}
+	return s.Name()
+}
+
+// postTgoStatus returns a function that tells uhura tgo has moved to the
+// named state
+func postTgoStatus(state string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		var r StatusReply
+		return PostStatusAndGetReply(ctx, envMap.ThisApp, state, &r)
+	}
+}
+
+// defaultStateGraph returns a graph containing the standard lifecycle
+func defaultStateGraph() *stateGraph {
+	g := newStateGraph("UNKNOWN")
+	g.register(&stdState{name: "UNKNOWN", handler: "StateUnknown", next: "INIT", target: STATEInitializing,
+		run: StateUnknown,
+		enter: func(ctx context.Context) error {
+			if err := postTgoStatus("INIT")(ctx); err != nil { // starting our state machine in the INIT state
+				return err
+			}
+			ulog("Orchestrator: StateUnknown started\n")
+			return nil
+		}})
+	g.register(&stdState{name: "INIT", handler: "StateInit", next: "READY", target: STATEInitializing,
+		run: StateInit,
+		enter: func(ctx context.Context) error {
+			ulog("Orchestrator: StateInit started\n")
+			return nil
+		}})
+	g.register(&stdState{name: "READY", handler: "StateReady", next: "TESTNOW", target: STATEReady,
+		run: StateReady,
+		enter: func(ctx context.Context) error {
+			// When we enter READY state, there's really nothing to do except
+			// wait for UHURA to send us a TESTNOW command. Then we start up
+			// the tests.
+			var r StatusReply
+			ulog("Orchestrator: Entering StateReady\n")
+			ulog("Orchestrator: Posted READY status to uhura. ReplyCode: %d\n", r.ReplyCode)
+			if err := PostStatusAndGetReply(ctx, envMap.ThisApp, "READY", &r); err != nil { // tell Uhura we're ready
+				return err
+			}
+			ulog("Orchestrator: Calling StateReady\n")
+			ulog("Orchestrator: waiting for StateReady to reply\n")
+			return nil
+		}})
+	g.register(&stdState{name: "TESTNOW", handler: "StateTestNow", next: "TEST", waitMsg: "TESTNOW from uhura",
+		run: StateTestNow})
+	g.register(&stdState{name: "TEST", handler: "StateTest", next: "RESULTS", target: STATEDone, testsonly: true,
+		run: StateTest,
+		enter: func(ctx context.Context) error {
+			var r StatusReply
+			if err := PostStatusAndGetReply(ctx, envMap.ThisApp, "TEST", &r); err != nil { // Tel UHURA we're moving to the TEST state
+				return err
+			}
+			ulog("Posted TEST status to uhura. ReplyCode: %d\n", r.ReplyCode)
+			return nil
+		}})
+	g.register(&stdState{name: "RESULTS", handler: "StateResults", next: "DONE", target: STATEDone, testsonly: true,
+		run: StateResults})
+	g.register(&stdState{name: "DONE", handler: "StateDone", target: STATEDone,
+		run: StateDone,
+		enter: func(ctx context.Context) error {
+			uploadArtifacts("DONE")
+			var r StatusReply
+			s := newStatusMsg(envMap.ThisApp, "DONE", "")
+			s.Tests = testTotals()
+			if err := PostMsgAndGetReply(ctx, envMap.ThisApp, &s, &r); err != nil {
+				return err
+			}
+			ulog("Posted DONE status to uhura. ReplyCode: %d\n", r.ReplyCode)
+			return nil
+		}})
+	return g
+}
+
+// stateDescr describes an additional state in the environment descriptor.
+type stateDescr struct {
+	Name    string   // name of the new state, e.g. SETUP_DATA
+	After   string   // the state this one follows, e.g. READY
+	Action  string   // the activate.sh command to call for each app
+	Expect  string   // the reply that means an app has completed the action, default "ok"
+	Apps    []string // UIDs of the apps to call, default is all apps other than tgo
+	Report  bool     // post this state to uhura for tgo when it is entered
+	Timeout int      // seconds allowed for the state, default 30 minutes
+	Poll    int      // seconds between calls to apps that have not completed, default 15
+}
+
+// actionState is a tgoState described in the environment descriptor. It
+// calls the same activate.sh command for each of its apps until they have
+// all replied with the expected value.
+type actionState struct {
+	d    stateDescr
+	done map[int]bool // the apps that have completed the action
+}
+
+func (s *actionState) Name() string { return s.d.Name }
+func (s *actionState) Next() string { return "" } // insertAfter sets its place in the graph
+
+func (s *actionState) Enter(ctx context.Context) error {
+	ulog("Orchestrator: %s started\n", s.d.Name)
+	if s.d.Report {
+		return postTgoStatus(s.d.Name)(ctx)
+	}
+	return nil
+}
+
+func (s *actionState) Timeout() time.Duration {
+	if s.d.Timeout > 0 {
+		return time.Duration(s.d.Timeout) * time.Second
+	}
+	return 30 * time.Minute
+}
+
+// apps returns the indeces of the apps this state calls
+func (s *actionState) apps() []int {
+	var idx []int
+	for i := 0; i < len(envMap.Instances[envMap.ThisInst].Apps); i++ {
+		if i == envMap.ThisApp {
+			continue
+		}
+		if len(s.d.Apps) == 0 {
+			idx = append(idx, i)
+			continue
+		}
+		for _, uid := range s.d.Apps {
+			if uid == envMap.Instances[envMap.ThisInst].Apps[i].UID {
+				idx = append(idx, i)
+			}
+		}
+	}
+	return idx
+}
+
+func (s *actionState) WaitingOn() string {
+	var uids []string
+	for _, i := range s.apps() {
+		if !s.done[i] {
+			uids = append(uids, envMap.Instances[envMap.ThisInst].Apps[i].UID)
+		}
+	}
+	return strings.Join(uids, ", ")
+}
+
+func (s *actionState) Run(ctx context.Context) <-chan stateResult {
+	c := make(chan stateResult, 1)
+	go func() {
+		ulog("Entering %s\n", s.d.Name)
+		c <- stateResult{0, s.run(ctx)}
+		ulog("%s: exiting 0\n", s.d.Name)
+	}()
+	return c
+}
+
+func (s *actionState) run(ctx context.Context) error {
+	expect := strings.ToLower(s.d.Expect)
+	if expect == "" {
+		expect = "ok"
+	}
+	poll := 15 * time.Second
+	if s.d.Poll > 0 {
+		poll = time.Duration(s.d.Poll) * time.Second
+	}
+	for {
+		remaining := 0
+		for _, i := range s.apps() {
+			if s.done[i] {
+				continue
+			}
+			a := &envMap.Instances[envMap.ThisInst].Apps[i]
+			if a.RunCmd != "" {
+				ulog("%s: %s is supervised by tgo, skipping %s\n", s.d.Name, a.UID, s.d.Action)
+				s.done[i] = true
+				continue
+			}
+			retval, err := activateCmd(ctx, i, s.d.Action)
+			if err != nil {
+				return err
+			}
+			rep := parseReply(retval)
+			if rep.Status == expect {
+				ulog("%s/activate.sh %s returns %s\n", appDir(a), s.d.Action, expect)
+				s.done[i] = true
+				continue
+			}
+			if err := replyError(i, s.d.Action, &rep); err != nil {
+				return err
+			}
+			ulog("%s/activate.sh %s returns: %s\n", appDir(a), s.d.Action, retval)
+			remaining++
+		}
+		if remaining == 0 {
+			return nil
+		}
+		ulog("%s: waiting on %d app(s)\n", s.d.Name, remaining)
+		if err := pause(ctx, poll); err != nil {
+			return err
+		}
+	}
+}
+
+// buildStateGraph returns the state graph for this run: the standard
+// lifecycle plus any states described in the environment descriptor.
+func buildStateGraph() (*stateGraph, error) {
+	g := defaultStateGraph()
+	for _, d := range envMap.States {
+		if d.Name == "" || d.Action == "" {
+			return nil, fmt.Errorf("state descriptor %+v needs a Name and an Action", d)
+		}
+		if err := g.insertAfter(d.After, &actionState{d: d, done: map[int]bool{}}); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := g.path(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
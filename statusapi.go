@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//  Status API.
+//
+//  tgo answers GET requests on its command port so a live instance can be
+//  inspected with curl:
+//
+//      /v1/status       tgo's state and the state of each app
+//      /v1/apps/<UID>   one app: its latest activation, process, restarts, health
+//      /v1/env          the environment descriptor tgo loaded
+//      /v1/events       a live stream of events, see events.go
+//
+//  The API is read-only. Commands from uhura are POSTed to / as before.
+//  When requests are signed (see auth.go) only the commands need to be;
+//  the API and /metrics stay open for curl and Prometheus, so /v1/env
+//  never shows the secret or where it and the TLS key are kept.
+
+// appSummary is an app's entry in the status
+type appSummary struct {
+	UID    string
+	Name   string
+	State  string
+	IsTest bool
+}
+
+// statusInfo is the reply to /v1/status
+type statusInfo struct {
+	EnvName      string
+	InstName     string
+	UID          string
+	State        string // the state tgo is in
+	StateEntered string `json:",omitempty"`
+	Started      string
+	Uptime       int // seconds
+	Apps         []appSummary
+}
+
+// procSummary describes an app's supervised process
+type procSummary struct {
+	Pid      int
+	Started  string
+	Running  bool
+	ExitCode *int `json:",omitempty"`
+}
+
+// healthSummary describes an app's health checks
+type healthSummary struct {
+	Healthy  bool
+	Passes   int // consecutive passes
+	Failures int // consecutive failures
+}
+
+// appInfo is the reply to /v1/apps/<UID>
+type appInfo struct {
+	appSummary
+	DependsOn      []string          `json:",omitempty"`
+	LastActivation *activationRecord `json:",omitempty"`
+	Process        *procSummary      `json:",omitempty"`
+	Restarts       int
+	Health         *healthSummary `json:",omitempty"`
+}
+
+// writeJSON sends v as the reply
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(b, '\n'))
+}
+
+// getOnly wraps a handler so it only answers GET requests
+func getOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "the status API is read-only", http.StatusMethodNotAllowed)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func summarize(a *appDescr) appSummary {
+	return appSummary{UID: a.UID, Name: a.Name, State: appStateName(appState(a)), IsTest: a.IsTest}
+}
+
+// statusHandler answers /v1/status
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	state, entered := currentState()
+	runInfo.Lock()
+	started := runInfo.started
+	runInfo.Unlock()
+	s := statusInfo{
+		EnvName:  envMap.EnvName,
+		InstName: envMap.Instances[envMap.ThisInst].InstName,
+		UID:      envMap.Instances[envMap.ThisInst].Apps[envMap.ThisApp].UID,
+		State:    state,
+		Started:  started.Format(time.RFC3339),
+		Uptime:   int(uptime() / time.Second),
+	}
+	if !entered.IsZero() {
+		s.StateEntered = entered.Format(time.RFC3339)
+	}
+	for i := range envMap.Instances[envMap.ThisInst].Apps {
+		s.Apps = append(s.Apps, summarize(&envMap.Instances[envMap.ThisInst].Apps[i]))
+	}
+	writeJSON(w, &s)
+}
+
+// appHandler answers /v1/apps/<UID>
+func appHandler(w http.ResponseWriter, r *http.Request) {
+	uid := strings.TrimPrefix(r.URL.Path, "/v1/apps/")
+	var a *appDescr
+	for i := range envMap.Instances[envMap.ThisInst].Apps {
+		if envMap.Instances[envMap.ThisInst].Apps[i].UID == uid {
+			a = &envMap.Instances[envMap.ThisInst].Apps[i]
+		}
+	}
+	if a == nil {
+		http.Error(w, "no app with UID "+uid, http.StatusNotFound)
+		return
+	}
+
+	info := appInfo{appSummary: summarize(a), DependsOn: a.DependsOn, Restarts: restartCount(a.UID)}
+	if rec, ok := lastActivation(uid); ok {
+		info.LastActivation = &rec
+	}
+	if p := getProc(uid); p != nil {
+		exited, code, _ := p.status()
+		info.Process = &procSummary{Pid: p.Pid, Started: p.Started.Format(time.RFC3339), Running: !exited}
+		if exited {
+			info.Process.ExitCode = &code
+		}
+	}
+	if a.Health != nil {
+		healthCounts.Lock()
+		if hc, ok := healthCounts.m[uid]; ok {
+			need := a.Health.Successes
+			if need < 1 {
+				need = 1
+			}
+			info.Health = &healthSummary{Healthy: hc.passes >= need, Passes: hc.passes, Failures: hc.failures}
+		}
+		healthCounts.Unlock()
+	}
+	writeJSON(w, &info)
+}
+
+// masked replaces a secret setting that is present
+func masked(s string) string {
+	if s == "" {
+		return ""
+	}
+	return "********"
+}
+
+// envHandler answers /v1/env. Secrets and the files holding them are not
+// shown.
+func envHandler(w http.ResponseWriter, r *http.Request) {
+	e := envSnapshot()
+	if e.Auth != nil {
+		a := *e.Auth
+		a.Secret, a.SecretFile = masked(a.Secret), masked(a.SecretFile)
+		e.Auth = &a
+	}
+	if e.TLS != nil {
+		td := *e.TLS
+		td.Key = masked(td.Key)
+		e.TLS = &td
+	}
+	writeJSON(w, &e)
+}
+
+// newCommsMux returns the handlers for tgo's command port: uhura's commands,
+// the status API and the metrics
+func newCommsMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", authenticated(CommsHandler))
+	mux.HandleFunc("/v1/status", getOnly(statusHandler))
+	mux.HandleFunc("/v1/apps/", getOnly(appHandler))
+	mux.HandleFunc("/v1/env", getOnly(envHandler))
+	mux.HandleFunc("/v1/events", getOnly(eventsHandler))
+	mux.HandleFunc("/metrics", getOnly(metricsHandler))
+	return mux
+}
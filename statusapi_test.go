@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// getJSON fetches path from the server and decodes the reply into v
+func getJSON(t *testing.T, ts *httptest.Server, path string, v interface{}) int {
+	resp, err := http.Get(ts.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestStatusAPI(t *testing.T) {
+	defer supervisedEnv(
+		appDescr{UID: "apisvc", Name: "apisvc", RunCmd: "sleep 30"},
+		appDescr{UID: "apitest", Name: "apitest", IsTest: true},
+	)()
+	envMap.EnvName = "StatusAPITest"
+	envMap.Instances[0].Apps[1].State = STATEReady
+	defer stopAllApps(0)
+	if s := act(1, "start"); s != "ok" {
+		t.Fatalf("start: expected ok, got %q", s)
+	}
+	setCurrentState("StateTest")
+	before := restartCount("apisvc")
+	noteRestart("apisvc", "test")
+
+	ts := httptest.NewServer(newCommsMux())
+	defer ts.Close()
+
+	var s statusInfo
+	if code := getJSON(t, ts, "/v1/status", &s); code != http.StatusOK {
+		t.Fatalf("/v1/status: got %d", code)
+	}
+	if s.EnvName != "StatusAPITest" || s.UID != "tgo0" || s.State != "StateTest" || len(s.Apps) != 3 {
+		t.Errorf("/v1/status: unexpected reply %+v", s)
+	}
+	if _, err := time.Parse(time.RFC3339, s.StateEntered); err != nil {
+		t.Errorf("/v1/status: bad StateEntered %q", s.StateEntered)
+	}
+	if s.Apps[1].State != appStateName(STATEReady) || !s.Apps[2].IsTest {
+		t.Errorf("/v1/status: unexpected apps %+v", s.Apps)
+	}
+
+	var a appInfo
+	if code := getJSON(t, ts, "/v1/apps/apisvc", &a); code != http.StatusOK {
+		t.Fatalf("/v1/apps/apisvc: got %d", code)
+	}
+	if a.LastActivation == nil || a.LastActivation.Cmd != "start" || a.LastActivation.Reply != "ok" {
+		t.Errorf("/v1/apps/apisvc: unexpected last activation %+v", a.LastActivation)
+	}
+	if a.Process == nil || !a.Process.Running || a.Process.Pid == 0 {
+		t.Errorf("/v1/apps/apisvc: unexpected process %+v", a.Process)
+	}
+	if a.Restarts != before+1 {
+		t.Errorf("/v1/apps/apisvc: expected %d restarts, got %d", before+1, a.Restarts)
+	}
+	if code := getJSON(t, ts, "/v1/apps/nosuchapp", &a); code != http.StatusNotFound {
+		t.Errorf("/v1/apps/nosuchapp: expected 404, got %d", code)
+	}
+
+	var e envDescr
+	if code := getJSON(t, ts, "/v1/env", &e); code != http.StatusOK || e.EnvName != "StatusAPITest" {
+		t.Errorf("/v1/env: got %d %+v", code, e)
+	}
+
+	resp, err := http.Post(ts.URL+"/v1/status", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST /v1/status: expected 405, got %d", resp.StatusCode)
+	}
+}
+
+func TestStatusAPIWhileStatesChange(t *testing.T) {
+	defer supervisedEnv(appDescr{UID: "apirace", Name: "apirace"})()
+	ts := httptest.NewServer(newCommsMux())
+	defer ts.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for s := STATEInitializing; s <= STATETerm; s++ {
+			setAppState(&envMap.Instances[0].Apps[1], s)
+		}
+	}()
+	for _, path := range []string{"/v1/status", "/v1/apps/apirace", "/v1/env"} {
+		var v interface{}
+		if code := getJSON(t, ts, path, &v); code != http.StatusOK {
+			t.Errorf("%s: got %d", path, code)
+		}
+	}
+	<-done
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//  Direct process supervision.
+//
+//  When an app's RunCmd is set, tgo launches the app's process itself
+//  rather than delegating to the app's activate.sh script. The process
+//  is tracked by PID and watched for exit, and the activation commands
+//  (start, ready, test, teststatus) are answered from what tgo knows
+//  about the process. The stop command signals the process, and
+//  everything it started, to exit; see procgroup.go.
+//  The replies use the same vocabulary as activate.sh so the state
+//  machine does not need to know which mechanism is in use.
+//
+//  RunCmd is split on whitespace and exec'd directly. It is not
+//  interpreted by a shell. The process's stdout and stderr are written to
+//  the app's log files.
+
+// procInfo describes a process that tgo has launched and is supervising.
+type procInfo struct {
+	UID      string
+	Pid      int
+	Started  time.Time
+	Exited   bool // true once the process has exited
+	ExitCode int  // valid only when Exited is true
+	Err      error
+	cmd      *exec.Cmd
+	done     chan struct{} // closed when the process exits
+}
+
+// procs is the table of supervised processes, indexed by app UID
+var procs = struct {
+	sync.Mutex
+	m map[string]*procInfo
+}{m: make(map[string]*procInfo)}
+
+// appDir returns the directory in which the app was installed
+func appDir(a *appDescr) string {
+	return fmt.Sprintf("../%s", a.Name)
+}
+
+// getProc returns the supervised process for the app with the supplied UID,
+// or nil if tgo has not launched one.
+func getProc(uid string) *procInfo {
+	procs.Lock()
+	defer procs.Unlock()
+	return procs.m[uid]
+}
+
+// status returns a snapshot of the process's exit information
+func (p *procInfo) status() (exited bool, code int, err error) {
+	procs.Lock()
+	defer procs.Unlock()
+	return p.Exited, p.ExitCode, p.Err
+}
+
+// startProc launches the app's RunCmd and starts a goroutine to watch for
+// its exit. If the app is already running it is left alone.
+func startProc(a *appDescr) string {
+	if p := getProc(a.UID); p != nil {
+		if exited, _, _ := p.status(); !exited {
+			ulog("startProc: %s is already running, pid %d\n", a.UID, p.Pid)
+			return "ok"
+		}
+	}
+	args := strings.Fields(a.RunCmd)
+	if len(args) == 0 {
+		return "error - empty RunCmd"
+	}
+	c := exec.Command(args[0], args[1:]...)
+	c.Stdout, c.Stderr = getAppOutput(a).begin(a.RunCmd)
+	c.WaitDelay = time.Second // don't wait on children that hold on to stdout or stderr
+	c.SysProcAttr = newGroup()
+	if fi, err := os.Stat(appDir(a)); err == nil && fi.IsDir() {
+		c.Dir = appDir(a)
+	} else {
+		ulog("startProc: no directory %s, running %s in the current directory\n", appDir(a), a.UID)
+	}
+	if err := c.Start(); err != nil {
+		ulog("startProc: could not start %s:  %v\n", a.RunCmd, err)
+		return fmt.Sprintf("error could not start %s: %v", a.UID, err)
+	}
+
+	p := &procInfo{UID: a.UID, Pid: c.Process.Pid, Started: time.Now(), cmd: c, done: make(chan struct{})}
+	procs.Lock()
+	procs.m[a.UID] = p
+	procs.Unlock()
+	ulog("startProc: started %s (%s), pid %d\n", a.UID, a.RunCmd, p.Pid)
+
+	go func() {
+		err := c.Wait()
+		procs.Lock()
+		p.Exited = true
+		p.ExitCode = c.ProcessState.ExitCode()
+		p.Err = err
+		procs.Unlock()
+		close(p.done)
+		ulog("supervisor: %s (pid %d) exited with code %d\n", p.UID, p.Pid, p.ExitCode)
+	}()
+	return "ok"
+}
+
+// procReady reports whether a supervised app is ready. A long-running app
+// is ready as long as its process is alive. Test apps are not launched
+// until the test command, so they are always ready before then.
+func procReady(a *appDescr) string {
+	p := getProc(a.UID)
+	if p == nil {
+		if a.IsTest {
+			return "ok"
+		}
+		return "error - process not started"
+	}
+	exited, code, _ := p.status()
+	if exited {
+		return fmt.Sprintf("error process %d exited with code %d%s", p.Pid, code, stderrTail(a))
+	}
+	return "ok"
+}
+
+// procTestStatus maps the state of a supervised test process onto the
+// replies expected for the teststatus command.
+func procTestStatus(a *appDescr) string {
+	p := getProc(a.UID)
+	if p == nil {
+		return "error - test process not started"
+	}
+	exited, code, _ := p.status()
+	switch {
+	case !exited:
+		return "testing"
+	case code == 0:
+		return "done"
+	default:
+		return fmt.Sprintf("error test process exited with code %d%s", code, stderrTail(a))
+	}
+}
+
+// stopProc asks a supervised process and the processes it started to exit
+// by sending SIGTERM to its process group. Anything in the group that has
+// not exited within the grace period is killed.
+func stopProc(a *appDescr, grace time.Duration) string {
+	p := getProc(a.UID)
+	if p == nil {
+		return "ok" // never started, nothing to stop
+	}
+	if exited, _, _ := p.status(); exited && !groupAlive(p.Pid) {
+		return "ok"
+	}
+	deadline := time.Now().Add(grace)
+	ulog("stopProc: sending SIGTERM to %s, process group %d\n", a.UID, p.Pid)
+	if err := signalGroup(p.Pid, syscall.SIGTERM); err != nil {
+		ulog("stopProc: could not signal %s: %v\n", a.UID, err)
+	}
+	select {
+	case <-p.done:
+	case <-time.After(grace):
+	}
+	killGroup(a.UID, p.Pid, time.Until(deadline))
+	select {
+	case <-p.done:
+		return "ok"
+	case <-time.After(5 * time.Second):
+		return fmt.Sprintf("error pid %d did not exit after SIGKILL", p.Pid)
+	}
+}
+
+// superviseCmd handles an activation command for an app whose process is
+// supervised directly by tgo. It returns a reply in the same format that
+// activate.sh would.
+func superviseCmd(i int, cmd string) string {
+	a := &envMap.Instances[envMap.ThisInst].Apps[i]
+	switch cmd {
+	case "start":
+		if a.IsTest {
+			return "ok" // test apps are launched by the test command
+		}
+		return startProc(a)
+	case "ready":
+		return procReady(a)
+	case "test":
+		return startProc(a)
+	case "teststatus":
+		return procTestStatus(a)
+	case "stop":
+		return stopProc(a, appTimeout(a, "TERM"))
+	default:
+		return fmt.Sprintf("error unknown command: %s", cmd)
+	}
+}
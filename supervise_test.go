@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// supervisedEnv replaces envMap with a single instance containing tgo and the
+// supplied apps. It returns a function that restores the original envMap.
+// App output is written to a temporary directory that is removed on restore.
+func supervisedEnv(apps ...appDescr) func() {
+	saved := envMap
+	dir, _ := ioutil.TempDir("", "tgologs")
+	envMap = envDescr{
+		UhuraURL: "http://localhost:8100/",
+		Instances: []instDescr{
+			{InstName: "SuperviseTest", Apps: append([]appDescr{{UID: "tgo0", Name: "tgo"}}, apps...)},
+		},
+		Logs: &logDescr{Dir: dir},
+	}
+	return func() {
+		envMap = saved
+		appOutputs.Lock()
+		appOutputs.m = make(map[string]*appOutput)
+		appOutputs.Unlock()
+		os.RemoveAll(dir)
+	}
+}
+
+// act calls activateCmd with no deadline and returns its reply
+func act(i int, cmd string) string {
+	s, err := activateCmd(context.Background(), i, cmd)
+	if err != nil {
+		return "error " + err.Error()
+	}
+	return s
+}
+
+// waitExit waits for the supervised process to exit
+func waitExit(t *testing.T, uid string) {
+	p := getProc(uid)
+	if p == nil {
+		t.Fatalf("no supervised process for %s", uid)
+	}
+	select {
+	case <-p.done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s did not exit", uid)
+	}
+}
+
+func TestSuperviseService(t *testing.T) {
+	defer supervisedEnv(appDescr{UID: "svc", Name: "svc", RunCmd: "sleep 1"})()
+
+	if s := act(1, "ready"); !strings.HasPrefix(s, "error") {
+		t.Errorf("ready before start: expected error, got %q", s)
+	}
+	if s := act(1, "start"); s != "ok" {
+		t.Fatalf("start: expected ok, got %q", s)
+	}
+	if s := act(1, "ready"); s != "ok" {
+		t.Errorf("ready while running: expected ok, got %q", s)
+	}
+	waitExit(t, "svc")
+	if s := act(1, "ready"); !strings.HasPrefix(s, "error") {
+		t.Errorf("ready after exit: expected error, got %q", s)
+	}
+}
+
+func TestSuperviseTest(t *testing.T) {
+	defer supervisedEnv(
+		appDescr{UID: "pass", Name: "pass", IsTest: true, RunCmd: "true"},
+		appDescr{UID: "fail", Name: "fail", IsTest: true, RunCmd: "false"},
+	)()
+
+	for i, uid := range []string{"pass", "fail"} {
+		if s := act(i+1, "start"); s != "ok" {
+			t.Errorf("%s start: expected ok, got %q", uid, s)
+		}
+		if getProc(uid) != nil {
+			t.Errorf("%s: test app was launched by start", uid)
+		}
+		if s := act(i+1, "test"); s != "ok" {
+			t.Fatalf("%s test: expected ok, got %q", uid, s)
+		}
+		waitExit(t, uid)
+	}
+	if s := act(1, "teststatus"); s != "done" {
+		t.Errorf("pass teststatus: expected done, got %q", s)
+	}
+	if s := act(2, "teststatus"); !strings.HasPrefix(s, "error") {
+		t.Errorf("fail teststatus: expected error, got %q", s)
+	}
+}
+
+func TestSuperviseStop(t *testing.T) {
+	// stubborn ignores SIGTERM, so it will need to be killed
+	script := filepath.Join(t.TempDir(), "stubborn.sh")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\ntrap '' TERM\nexec sleep 30\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer supervisedEnv(
+		appDescr{UID: "polite", Name: "polite", RunCmd: "sleep 30"},
+		appDescr{UID: "stubborn", Name: "stubborn", RunCmd: script, Timeouts: &timeoutDescr{Term: 1}},
+	)()
+
+	for i := 1; i <= 2; i++ {
+		if s := act(i, "start"); s != "ok" {
+			t.Fatalf("start app %d: expected ok, got %q", i, s)
+		}
+	}
+	time.Sleep(100 * time.Millisecond) // let stubborn set its trap
+	start := time.Now()
+	if fails := stopAllApps(0); len(fails) != 0 {
+		t.Errorf("expected all apps to stop, got %v", fails)
+	}
+	if d := time.Since(start); d < time.Second || d > 5*time.Second {
+		t.Errorf("expected stubborn to be killed after its 1s grace period, took %v", d)
+	}
+	for _, uid := range []string{"polite", "stubborn"} {
+		if exited, _, _ := getProc(uid).status(); !exited {
+			t.Errorf("%s is still running", uid)
+		}
+	}
+	if envMap.Instances[0].Apps[1].State != STATETerm || envMap.Instances[0].Apps[2].State != STATETerm {
+		t.Errorf("apps were not moved to STATETerm")
+	}
+}
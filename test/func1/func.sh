@@ -154,6 +154,7 @@ declare -a tgo_variants=(
         'StateReady: exiting 0'
         'Tgo response received'
         'Orchestrator: Posted READY status to uhura. ReplyCode: 0'
+        'os.Stat('
 )
 if [ ${UDIFFS} -gt 0 ]; then
         diff v w | grep "^[<>]" | perl -pe "s/^[<>]//" | uniq >u
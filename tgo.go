@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -27,6 +30,7 @@ type TGOApp struct {
 	State         int
 	LogFile       *os.File
 	UhuraComm     chan int // communications from Uhura
+	StopComm      chan int // STOP and ABORT commands from Uhura, or a signal
 	Port          int      // What port are we listening on
 	Debug         bool     // Debug mode -- show ulog messages on screen
 	DebugToScreen bool     // Send logging info to screen too
@@ -47,6 +51,10 @@ func processCommandLine() {
 	dbugPtr := flag.Bool("d", false, "debug mode - includes debug info in logfile")
 	dtscPtr := flag.Bool("D", false, "LogToScreen mode - prints log messages to stdout")
 	itstPtr := flag.Bool("F", false, "Internal Functional Test mode")
+	flag.StringVar(&tlsFlags.Cert, "tlscert", "", "PEM certificate for TLS, overrides the environment descriptor")
+	flag.StringVar(&tlsFlags.Key, "tlskey", "", "PEM private key for -tlscert")
+	flag.StringVar(&tlsFlags.CA, "tlsca", "", "PEM bundle of CAs trusted to sign uhura's certificate")
+	flag.BoolVar(&tlsFlags.Mutual, "tlsmutual", false, "require clients of the command port to present a certificate")
 	flag.Parse()
 	Tgo.Debug = *dbugPtr
 	Tgo.DebugToScreen = *dtscPtr
@@ -66,26 +74,51 @@ func readEnvDescr(filename string) {
 		ulog("File error on %s: %#v\n", filename, e)
 		os.Exit(1) // no recovery from this
 	}
-	ulog("%s\n", string(content))
-
 	// OK, now we have the json describing the environment in content (a string)
 	// Parse it into an internal data structure...
 	err := json.Unmarshal(content, &envMap)
+	ulog("%s\n", maskSecret(string(content)))
 	if err != nil {
 		ulog("Error unmarshaling Environment Descriptor json: %s\n", err)
 		check(err)
 	}
+	findTgo()
+	if err := checkEnvDescr(); err != nil {
+		ulog("Error in Environment Descriptor: %s\n", err)
+		os.Exit(1) // no recovery from this
+	}
 }
 
-func whoAmI() {
-	filename := "uhura_map.json"
-	readEnvDescr(filename)
-	ulog("readEnvDescr - Loading %s\n", filename)
-	// DPrintEnvDescr("envMap after initial parse:")
-	ulog("uhura url: %s\n", envMap.UhuraURL)
+// checkEnvDescr returns an error for the first setting in the environment
+// descriptor that tgo cannot act on
+func checkEnvDescr() error {
+	if envMap.ThisInst < len(envMap.Instances) {
+		if _, err := appWaves(); err != nil { // unknown dependencies and cycles
+			return err
+		}
+	}
+	for i := range envMap.Instances {
+		for j := range envMap.Instances[i].Apps {
+			a := &envMap.Instances[i].Apps[j]
+			if err := checkRestart(a); err != nil {
+				return err
+			}
+			if err := checkHealthDescr(a); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
 
-	// Uhura tells us which instance we are, but it does not look up the app
-	// and tell us which app instance. So we look it up here...
+// findTgo sets envMap.ThisApp to tgo's index in its instance. Uhura tells
+// us which instance we are, but it does not look up the app and tell us
+// which app instance. So we look it up here. It reports whether tgo was
+// found.
+func findTgo() bool {
+	if envMap.ThisInst >= len(envMap.Instances) {
+		return false
+	}
 	var found bool
 	for i := 0; i < len(envMap.Instances[envMap.ThisInst].Apps); i++ {
 		if envMap.Instances[envMap.ThisInst].Apps[i].Name == "tgo" {
@@ -93,7 +126,18 @@ func whoAmI() {
 			found = true
 		}
 	}
-	if !found {
+	return found
+}
+
+func whoAmI() {
+	filename := "uhura_map.json"
+	readEnvDescr(filename)
+	applyTLSFlags()
+	ulog("readEnvDescr - Loading %s\n", filename)
+	// DPrintEnvDescr("envMap after initial parse:")
+	ulog("uhura url: %s\n", envMap.UhuraURL)
+
+	if !findTgo() {
 		ulog("*** NOTICE ***  did not find tgo in uhura_map.json instance %d\n", envMap.ThisInst)
 	}
 	ulog("There are %d apps on this instance:\n", len(envMap.Instances[envMap.ThisInst].Apps))
@@ -105,7 +149,18 @@ func whoAmI() {
 func initTgo() {
 	ulog("**********   T G O   **********\n")
 	whoAmI()
-	Tgo.UhuraComm = make(chan int)
+	Tgo.UhuraComm = make(chan int, 1)
+	Tgo.StopComm = make(chan int, 1) // the first STOP or ABORT wins
+}
+
+// stopOnSignal waits for SIGINT or SIGTERM and stops the run the same way
+// uhura's STOP command does, so the apps are not left running.
+func stopOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	sig := <-c
+	ulog("Received signal %v, stopping\n", sig)
+	requestStop(cmdSIGNAL)
 }
 
 // This is uhura's standard loger
@@ -141,9 +196,13 @@ func main() {
 		errcount := IntFuncTest0()
 		ulog("IntFuncTest0 error count: %d\n", errcount)
 	default:
-		c := make(chan int)                        // a channel to signal us when it's all done
-		InitiateStateMachine(c)                    // initiate and pass in the channel
-		<-c                                        // wait til it's done
-		time.Sleep(time.Duration(1 * time.Second)) // grace period, let everything finish
+		go stopOnSignal()                             // SIGINT and SIGTERM stop the run like uhura's STOP
+		c := make(chan int)                           // a channel to signal us when it's all done
+		InitiateStateMachine(context.Background(), c) // initiate and pass in the channel
+		rc := <-c                                     // wait til it's done
+		time.Sleep(time.Duration(1 * time.Second))    // grace period, let everything finish
+		if rc != 0 {
+			os.Exit(rc)
+		}
 	}
 }
@@ -2,8 +2,10 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"math/rand"
 	"net/http"
 	"os"
 	"time"
@@ -12,10 +14,14 @@ import (
 // StatusMsg is status message structure we use to
 // communicate with uhura.
 type StatusMsg struct {
-	State    string
-	InstName string
-	UID      string
-	Tstamp   string
+	State     string
+	InstName  string
+	UID       string
+	Tstamp    string
+	Reason    string      `json:",omitempty"` // why the app is BLOCKED
+	Tests     *testCounts `json:",omitempty"` // test results, with tgo's DONE status
+	Version   int         `json:",omitempty"` // protocol version, from 2 on
+	RequestID string      `json:",omitempty"` // from protocol 2 on, echoed in the reply
 }
 
 // StatusReply represents the structure of information
@@ -24,6 +30,9 @@ type StatusReply struct {
 	Status    string
 	ReplyCode int
 	Timestamp string
+	Version   int    `json:",omitempty"` // protocol version, from 2 on
+	Code      string `json:",omitempty"` // ReplyCode by name, from protocol 2 on
+	RequestID string `json:",omitempty"` // the RequestID of the request
 }
 
 // UCommand is the structure of commands that Uhura sends TGO
@@ -31,61 +40,222 @@ type UCommand struct {
 	Command   string
 	CmdCode   int
 	Timestamp string
+	Version   int      `json:",omitempty"` // protocol version, from 2 on
+	RequestID string   `json:",omitempty"` // from protocol 2 on, echoed in the reply
+	Features  []string `json:",omitempty"` // uhura's features, with HELLO
 }
 
 // RespOK and the rest are meaningful names associated with the
-// StatusReply.ReplyCode that uhura sends TGO
+// StatusReply.ReplyCode that uhura sends TGO. Protocol 2 also sends
+// them by name, see replyCodeNames.
 const (
 	RespOK             = iota // 0
 	RespNoSuchInstance        // 1
-	InvalidState              // 2
+	InvalidState              // 2 Deprecated: means the same as RespInvalidState
 	RespBadCmd                // 3
 	RespInvalidState          // 4
+	RespUnauthorized          // 5 the request was not signed correctly
 )
 
+// retryDescr describes how PostStatus retries status messages that could
+// not be delivered. A value of 0 means the default is used.
+type retryDescr struct {
+	Attempts   int // total number of attempts, including the first
+	Backoff    int // milliseconds to wait before the first retry, doubled for each retry after
+	MaxBackoff int // milliseconds, upper limit on the wait between retries
+	Timeout    int // seconds allowed for each attempt
+}
+
+// defaultRetry are the retry settings used for any value not supplied in
+// the environment descriptor
+var defaultRetry = retryDescr{
+	Attempts:   5,
+	Backoff:    500,
+	MaxBackoff: 30 * 1000,
+	Timeout:    30,
+}
+
+// PostError is the error returned by PostStatus when a status message
+// could not be delivered to uhura.
+type PostError struct {
+	Attempts   int   // number of attempts made
+	StatusCode int   // HTTP status code of the last response, 0 if there was none
+	Transient  bool  // true if the last failure was of a kind we retry
+	Err        error // the error from the last attempt
+}
+
+func (e *PostError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("status not delivered after %d attempt(s), HTTP %d: %v", e.Attempts, e.StatusCode, e.Err)
+	}
+	return fmt.Sprintf("status not delivered after %d attempt(s): %v", e.Attempts, e.Err)
+}
+
+// retrySettings returns the retry settings from the environment descriptor
+// with defaults filled in
+func retrySettings() retryDescr {
+	rs := defaultRetry
+	if envMap.Retry != nil {
+		if envMap.Retry.Attempts > 0 {
+			rs.Attempts = envMap.Retry.Attempts
+		}
+		if envMap.Retry.Backoff > 0 {
+			rs.Backoff = envMap.Retry.Backoff
+		}
+		if envMap.Retry.MaxBackoff > 0 {
+			rs.MaxBackoff = envMap.Retry.MaxBackoff
+		}
+		if envMap.Retry.Timeout > 0 {
+			rs.Timeout = envMap.Retry.Timeout
+		}
+	}
+	return rs
+}
+
+// backoff returns the time to wait before retry number n (starting at 1).
+// The wait doubles with each retry up to the limit, and half of it is
+// randomized so that every tgo in an environment doesn't hit a restarted
+// uhura at the same instant.
+func backoff(rs *retryDescr, n int) time.Duration {
+	d := time.Duration(rs.Backoff) * time.Millisecond
+	max := time.Duration(rs.MaxBackoff) * time.Millisecond
+	for i := 1; i < n && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// postOnce makes a single attempt to post a status message to uhura at
+// url. It returns the HTTP status code, whether a failure is worth retrying,
+// and any error.
+func postOnce(ctx context.Context, client *http.Client, url string, b []byte, r *StatusReply) (int, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(b))
+	if err != nil {
+		return 0, false, err // a bad URL won't get any better
+	}
+	if err := signRequest(req, b); err != nil {
+		return 0, false, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, ctx.Err() == nil, err // connection refused, timeout, reset, ... but not if we were cancelled
+	}
+	defer resp.Body.Close()
+
+	rc := resp.StatusCode
+	*r = StatusReply{} // nothing left over from an earlier reply
+	if rc >= 500 {
+		return rc, true, fmt.Errorf("server error: %s", resp.Status)
+	}
+	if rc == http.StatusUnauthorized {
+		json.NewDecoder(resp.Body).Decode(r)
+		r.normalize()
+		return rc, false, fmt.Errorf("uhura rejected the request: %s", r.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(r); err != nil {
+		return rc, false, fmt.Errorf("could not decode reply to HTTP %d: %v", rc, err) // server errors were retried above
+	}
+	r.normalize()
+	return rc, false, nil
+}
+
 // PostStatus is used to send a status message to uhura
-// returns the HTTP statuscode of the response and the error
-// from the http.POST
+// returns the HTTP statuscode of the response and the error.
+// Connection failures and server errors are retried with backoff. If the message cannot be delivered the error
+// is a *PostError. The message goes by the configured StatusTransport.
 func PostStatus(sm *StatusMsg, r *StatusReply) (int, error) {
+	return PostStatusCtx(context.Background(), sm, r)
+}
+
+// PostStatusCtx is PostStatus, but it gives up if ctx is cancelled.
+func PostStatusCtx(ctx context.Context, sm *StatusMsg, r *StatusReply) (int, error) {
+	return postStatus(ctx, sm, r, retrySettings())
+}
+
+// postStatus is PostStatusCtx with the supplied retry settings
+func postStatus(ctx context.Context, sm *StatusMsg, r *StatusReply, rs retryDescr) (int, error) {
+	stampMsg(sm)
 	b, err := json.Marshal(sm)
 	if err != nil {
 		ulog("Cannot marshal status struct! Error: %v\n", err)
 		os.Exit(2) // no recovery from this
 	}
-	req, err := http.NewRequest("POST", envMap.UhuraURL+"status/", bytes.NewBuffer(b))
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	pe := PostError{}
+	tr, err := statusTransport(time.Duration(rs.Timeout) * time.Second)
 	if err != nil {
-		ulog("Cannot Post status message! Error: %v\n", err)
-		return 0, err // ?? maybe there's some retry we can do??
+		pe.Err = err
+		ulog("Cannot Post status message! Error: %v\n", &pe)
+		metricPost(sm.State, true)
+		publish(event{Type: evStatusPosted, UID: sm.UID, State: sm.State, Err: pe.Error()})
+		return 0, &pe
 	}
-	defer resp.Body.Close()
-
-	// pull out the HTTP response code
-	var rc int
-	var more string
-	fmt.Sscanf(resp.Status, "%d %s", &rc, &more)
-
-	// body, _ := ioutil.ReadAll(resp.Body)
-	// ulog("raw reply data: %s\n", string(body))
-	// json.Unmarshal(body, r)
-	decoder := json.NewDecoder(resp.Body)
-	if err := decoder.Decode(r); err != nil {
-		panic(err)
+	for pe.Attempts < rs.Attempts {
+		if pe.Attempts > 0 {
+			d := backoff(&rs, pe.Attempts)
+			ulog("PostStatus: attempt %d failed: %v.  Retrying in %v\n", pe.Attempts, pe.Err, d)
+			select {
+			case <-ctx.Done():
+				pe.Err, pe.Transient = ctx.Err(), false
+				ulog("Cannot Post status message! Error: %v\n", &pe)
+				metricPost(sm.State, true)
+				publish(event{Type: evStatusPosted, UID: sm.UID, State: sm.State, Err: pe.Error()})
+				return pe.StatusCode, &pe
+			case <-time.After(d):
+			}
+		}
+		pe.Attempts++
+		metricPost(sm.State, false)
+		pe.StatusCode, pe.Transient, pe.Err = tr.Post(ctx, b, r)
+		if pe.Err == nil {
+			if sm.RequestID != "" && r.RequestID != "" && r.RequestID != sm.RequestID {
+				ulog("PostStatus: reply is for request %s, not %s\n", r.RequestID, sm.RequestID)
+			}
+			publish(event{Type: evStatusPosted, UID: sm.UID, State: sm.State})
+			return pe.StatusCode, nil
+		}
+		if !pe.Transient {
+			break
+		}
 	}
-	return rc, err
+	ulog("Cannot Post status message! Error: %v\n", &pe)
+	metricPost(sm.State, true)
+	publish(event{Type: evStatusPosted, UID: sm.UID, State: sm.State, Err: pe.Error()})
+	return pe.StatusCode, &pe
 }
 
 // SendReply sends a response back to uhura.
 func SendReply(w http.ResponseWriter, rc int, s string) {
+	replyTo(w, nil, rc, s)
+}
+
+// replyTo sends a response to the command c back to uhura, in the protocol
+// version of the command. c may be nil if the command could not be read.
+func replyTo(w http.ResponseWriter, c *UCommand, rc int, s string) {
 	w.Header().Set("Content-Type", "application/json")
 	m := StatusReply{Status: s, ReplyCode: rc, Timestamp: time.Now().Format(time.RFC822)}
+	if c != nil && c.Version >= protoV2 {
+		m.Version, m.Code, m.RequestID = protoV2, replyCodeName(rc), c.RequestID
+		m.Timestamp = time.Now().Format(time.RFC3339)
+	}
 	str, err := json.Marshal(m)
 	if nil != err {
 		fmt.Fprintf(w, "{\n\"Status\": \"%s\"\n\"Timestamp:\": \"%s\"\n}\n",
 			"encoding error", time.Now().Format(time.RFC822))
 	} else {
-		fmt.Fprintf(w, string(str))
+		w.Write(str)
+	}
+}
+
+// requestStop passes a STOP or ABORT command on to the state machine. The
+// orchestrator picks it up whatever state it is in.
+func requestStop(cmd int) {
+	select {
+	case Tgo.StopComm <- cmd:
+	default:
+		ulog("requestStop: stop already in progress, ignoring %d\n", cmd)
 	}
 }
 
@@ -96,7 +266,7 @@ func CommsHandler(w http.ResponseWriter, r *http.Request) {
 	var s UCommand
 	decoder := json.NewDecoder(r.Body)
 	if err := decoder.Decode(&s); err != nil {
-		ulog("CommsHandler could not decode message:\n%s\nWill ignore this message\n", s)
+		ulog("CommsHandler could not decode message:\n%+v\nWill ignore this message\n", s)
 		SendReply(w, 0, "Undecodable Message")
 		return
 	}
@@ -104,25 +274,46 @@ func CommsHandler(w http.ResponseWriter, r *http.Request) {
 	ulog("Received comms from Uhura:  %+v\n", s)
 	switch {
 	case s.Command == "TESTNOW":
-		SendReply(w, RespOK, "OK")
-		Tgo.UhuraComm <- s.CmdCode // tell the state machine to proceed
-		<-Tgo.UhuraComm            // wait til the handler says it's ok to proceed
+		select {
+		case Tgo.UhuraComm <- s.CmdCode: // tell the state machine to proceed
+			replyTo(w, &s, RespOK, "OK")
+		default:
+			replyTo(w, &s, RespInvalidState, "TESTNOW already received")
+		}
+	case s.Command == "STOP":
+		replyTo(w, &s, RespOK, "OK")
+		requestStop(cmdSTOP)
+	case s.Command == "ABORT":
+		replyTo(w, &s, RespOK, "OK")
+		requestStop(cmdABORT)
+	case s.Command == "HELLO":
+		answerHello(w, &s)
 	default:
 		ulog("Received unknown cmd from Uhura: %+v", s)
-		SendReply(w, RespBadCmd, "BADCMD")
+		replyTo(w, &s, RespBadCmd, "BADCMD")
 	}
 }
 
 // UhuraComms sets up the handlers for any commands that Uhura sends this
 // TGO instance. The main thing Uhura contacts us about is to
-// notify us when testing can begin.
+// notify us when testing can begin. The same port serves the status API.
 func UhuraComms() {
 	// Set up an http service that listens on our assigned
 	// port for any messages
-	http.HandleFunc("/", CommsHandler)
 	s := fmt.Sprintf(":%d",
 		envMap.Instances[envMap.ThisInst].Apps[envMap.ThisApp].UPort)
+	srv, err := commsServer(s)
+	if err != nil {
+		ulog("UhuraComms cannot listen for commands: %v\n", err)
+		os.Exit(1) // no recovery from this
+	}
+	if srv.TLSConfig != nil {
+		ulog("UhuraComms https service listening on port: %d\n",
+			envMap.Instances[envMap.ThisInst].Apps[envMap.ThisApp].UPort)
+		go srv.ListenAndServeTLS("", "")
+		return
+	}
 	ulog("UhuraComms http service listening on port: %d\n",
 		envMap.Instances[envMap.ThisInst].Apps[envMap.ThisApp].UPort)
-	go http.ListenAndServe(s, nil)
+	go srv.ListenAndServe()
 }
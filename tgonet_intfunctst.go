@@ -17,18 +17,18 @@ type cft struct {
 //  as well as functional testing
 var tests = []cft{
 	// test#  http	StatusMsg								          Expected StatusReply
-	cft{1, 200, StatusMsg{"INIT", "MainTestInstance", "wprog2", "x"}, StatusReply{"x", RespNoSuchInstance, "x"}},
-	cft{1, 200, StatusMsg{"YACK", "MainTestInstance", "prog2", "x"}, StatusReply{"x", InvalidState, "x"}},
-	cft{1, 200, StatusMsg{"YACK", "MainWinInstance", "prog2", "x"}, StatusReply{"x", RespNoSuchInstance, "x"}},
-	cft{1, 200, StatusMsg{"ARGH", "MainWinInstance", "wprog2", "x"}, StatusReply{"x", InvalidState, "x"}},
-	cft{1, 200, StatusMsg{"INIT", "MainTestInstance", "prog2", "x"}, StatusReply{"x", RespOK, "x"}},
-	cft{1, 200, StatusMsg{"INIT", "MainWinInstance", "wprog2", "x"}, StatusReply{"x", RespOK, "x"}},
-	cft{1, 200, StatusMsg{"READY", "MainTestInstance", "prog2", "x"}, StatusReply{"x", RespOK, "x"}},
-	cft{1, 200, StatusMsg{"READY", "MainWinInstance", "wprog2", "x"}, StatusReply{"x", RespOK, "x"}},
-	cft{1, 200, StatusMsg{"TEST", "MainTestInstance", "prog2", "x"}, StatusReply{"x", RespOK, "x"}},
-	cft{1, 200, StatusMsg{"TEST", "MainWinInstance", "wprog2", "x"}, StatusReply{"x", RespOK, "x"}},
-	cft{1, 200, StatusMsg{"DONE", "MainTestInstance", "prog2", "x"}, StatusReply{"x", RespOK, "x"}},
-	cft{1, 200, StatusMsg{"DONE", "MainWinInstance", "wprog2", "x"}, StatusReply{"x", RespOK, "x"}},
+	cft{1, 200, StatusMsg{State: "INIT", InstName: "MainTestInstance", UID: "wprog2", Tstamp: "x"}, StatusReply{Status: "x", ReplyCode: RespNoSuchInstance, Timestamp: "x"}},
+	cft{1, 200, StatusMsg{State: "YACK", InstName: "MainTestInstance", UID: "prog2", Tstamp: "x"}, StatusReply{Status: "x", ReplyCode: InvalidState, Timestamp: "x"}},
+	cft{1, 200, StatusMsg{State: "YACK", InstName: "MainWinInstance", UID: "prog2", Tstamp: "x"}, StatusReply{Status: "x", ReplyCode: RespNoSuchInstance, Timestamp: "x"}},
+	cft{1, 200, StatusMsg{State: "ARGH", InstName: "MainWinInstance", UID: "wprog2", Tstamp: "x"}, StatusReply{Status: "x", ReplyCode: InvalidState, Timestamp: "x"}},
+	cft{1, 200, StatusMsg{State: "INIT", InstName: "MainTestInstance", UID: "prog2", Tstamp: "x"}, StatusReply{Status: "x", ReplyCode: RespOK, Timestamp: "x"}},
+	cft{1, 200, StatusMsg{State: "INIT", InstName: "MainWinInstance", UID: "wprog2", Tstamp: "x"}, StatusReply{Status: "x", ReplyCode: RespOK, Timestamp: "x"}},
+	cft{1, 200, StatusMsg{State: "READY", InstName: "MainTestInstance", UID: "prog2", Tstamp: "x"}, StatusReply{Status: "x", ReplyCode: RespOK, Timestamp: "x"}},
+	cft{1, 200, StatusMsg{State: "READY", InstName: "MainWinInstance", UID: "wprog2", Tstamp: "x"}, StatusReply{Status: "x", ReplyCode: RespOK, Timestamp: "x"}},
+	cft{1, 200, StatusMsg{State: "TEST", InstName: "MainTestInstance", UID: "prog2", Tstamp: "x"}, StatusReply{Status: "x", ReplyCode: RespOK, Timestamp: "x"}},
+	cft{1, 200, StatusMsg{State: "TEST", InstName: "MainWinInstance", UID: "wprog2", Tstamp: "x"}, StatusReply{Status: "x", ReplyCode: RespOK, Timestamp: "x"}},
+	cft{1, 200, StatusMsg{State: "DONE", InstName: "MainTestInstance", UID: "prog2", Tstamp: "x"}, StatusReply{Status: "x", ReplyCode: RespOK, Timestamp: "x"}},
+	cft{1, 200, StatusMsg{State: "DONE", InstName: "MainWinInstance", UID: "wprog2", Tstamp: "x"}, StatusReply{Status: "x", ReplyCode: RespOK, Timestamp: "x"}},
 }
 
 // IntFuncTest0 sends a number of common commands to a local uhura.
@@ -27,16 +27,16 @@ var tgont struct {
 //  as well as functional testing
 var Tests = []ct{
 	// test#  http	StatusMsg								          Expected StatusReply
-	ct{1, 200, StatusMsg{"INIT", "MainTestInstance", "wprog2", "x"}, StatusReply{"x", RespNoSuchInstance, "x"}},
-	ct{1, 200, StatusMsg{"INIT", "MainTestInstance", "prog2", "x"}, StatusReply{"x", InvalidState, "x"}},
-	ct{1, 200, StatusMsg{"INIT", "MainTestInstance", "prog2", "x"}, StatusReply{"x", RespOK, "x"}},
-	ct{1, 200, StatusMsg{"INIT", "MainWinInstance", "wprog2", "x"}, StatusReply{"x", RespOK, "x"}},
-	ct{1, 200, StatusMsg{"READY", "MainTestInstance", "prog2", "x"}, StatusReply{"x", RespOK, "x"}},
-	ct{1, 200, StatusMsg{"READY", "MainWinInstance", "wprog2", "x"}, StatusReply{"x", RespOK, "x"}},
-	ct{1, 200, StatusMsg{"TEST", "MainTestInstance", "prog2", "x"}, StatusReply{"x", RespOK, "x"}},
-	ct{1, 200, StatusMsg{"TEST", "MainWinInstance", "wprog2", "x"}, StatusReply{"x", RespOK, "x"}},
-	ct{1, 200, StatusMsg{"DONE", "MainTestInstance", "prog2", "x"}, StatusReply{"x", RespOK, "x"}},
-	ct{1, 200, StatusMsg{"DONE", "MainWinInstance", "wprog2", "x"}, StatusReply{"x", RespOK, "x"}},
+	ct{1, 200, StatusMsg{State: "INIT", InstName: "MainTestInstance", UID: "wprog2", Tstamp: "x"}, StatusReply{Status: "x", ReplyCode: RespNoSuchInstance, Timestamp: "x"}},
+	ct{1, 200, StatusMsg{State: "INIT", InstName: "MainTestInstance", UID: "prog2", Tstamp: "x"}, StatusReply{Status: "x", ReplyCode: InvalidState, Timestamp: "x"}},
+	ct{1, 200, StatusMsg{State: "INIT", InstName: "MainTestInstance", UID: "prog2", Tstamp: "x"}, StatusReply{Status: "x", ReplyCode: RespOK, Timestamp: "x"}},
+	ct{1, 200, StatusMsg{State: "INIT", InstName: "MainWinInstance", UID: "wprog2", Tstamp: "x"}, StatusReply{Status: "x", ReplyCode: RespOK, Timestamp: "x"}},
+	ct{1, 200, StatusMsg{State: "READY", InstName: "MainTestInstance", UID: "prog2", Tstamp: "x"}, StatusReply{Status: "x", ReplyCode: RespOK, Timestamp: "x"}},
+	ct{1, 200, StatusMsg{State: "READY", InstName: "MainWinInstance", UID: "wprog2", Tstamp: "x"}, StatusReply{Status: "x", ReplyCode: RespOK, Timestamp: "x"}},
+	ct{1, 200, StatusMsg{State: "TEST", InstName: "MainTestInstance", UID: "prog2", Tstamp: "x"}, StatusReply{Status: "x", ReplyCode: RespOK, Timestamp: "x"}},
+	ct{1, 200, StatusMsg{State: "TEST", InstName: "MainWinInstance", UID: "wprog2", Tstamp: "x"}, StatusReply{Status: "x", ReplyCode: RespOK, Timestamp: "x"}},
+	ct{1, 200, StatusMsg{State: "DONE", InstName: "MainTestInstance", UID: "prog2", Tstamp: "x"}, StatusReply{Status: "x", ReplyCode: RespOK, Timestamp: "x"}},
+	ct{1, 200, StatusMsg{State: "DONE", InstName: "MainWinInstance", UID: "wprog2", Tstamp: "x"}, StatusReply{Status: "x", ReplyCode: RespOK, Timestamp: "x"}},
 }
 
 func setup() {
@@ -49,7 +49,7 @@ func setup() {
 }
 
 func UhuraStatusHandler(w http.ResponseWriter, r *http.Request) {
-	sr := StatusReply{"x", Tests[tgont.curTest].ur.ReplyCode, time.Now().Format(time.RFC822)}
+	sr := StatusReply{Status: "x", ReplyCode: Tests[tgont.curTest].ur.ReplyCode, Timestamp: time.Now().Format(time.RFC822)}
 	w.Header().Add("Content-Type", "application/json")
 	b, _ := json.Marshal(sr)
 	fmt.Fprint(w, string(b))
@@ -68,6 +68,8 @@ func TestSendStatus(t *testing.T) {
 func TgoNetTest(t *testing.T, expectHTTPResponse int, sm *StatusMsg, urexpect *StatusReply) {
 	ts := httptest.NewServer(http.HandlerFunc(UhuraStatusHandler))
 	defer ts.Close()
+	savedURL := envMap.UhuraURL
+	defer func() { envMap.UhuraURL = savedURL }()
 	envMap.UhuraURL = ts.URL + "/"
 
 	// Call PostStatus and let's see what we get back
@@ -87,3 +89,105 @@ func TgoNetTest(t *testing.T, expectHTTPResponse int, sm *StatusMsg, urexpect *S
 		return
 	}
 }
+
+func TestPostFailure(t *testing.T) {
+	var got StatusMsg
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		b, _ := json.Marshal(StatusReply{Status: "OK", ReplyCode: RespOK, Timestamp: time.Now().Format(time.RFC822)})
+		fmt.Fprint(w, string(b))
+	}))
+	defer ts.Close()
+	defer supervisedEnv(appDescr{UID: "svc", Name: "svc"})()
+	envMap.UhuraURL = ts.URL + "/"
+
+	PostFailure(1, "svc would not start")
+	if got.State != "BLOCKED" || got.UID != "svc" || got.InstName != "SuperviseTest" {
+		t.Errorf("unexpected status message: %+v", got)
+	}
+	if got.Reason != "svc would not start" {
+		t.Errorf("expected reason to be sent, got %q", got.Reason)
+	}
+}
+
+func TestPostFinalStatusOnce(t *testing.T) {
+	var calls int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	defer supervisedEnv(appDescr{UID: "svc", Name: "svc"})()
+	envMap.UhuraURL = ts.URL + "/"
+	envMap.Retry = &retryDescr{Attempts: 5, Backoff: 1000}
+
+	start := time.Now()
+	PostFinalStatus(1, "TERM", "")
+	if calls != 1 {
+		t.Errorf("expected 1 attempt, got %d", calls)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("final status took %v", d)
+	}
+}
+
+func TestPostStatusRetry(t *testing.T) {
+	saved, savedURL := envMap.Retry, envMap.UhuraURL
+	defer func() { envMap.Retry, envMap.UhuraURL = saved, savedURL }()
+	envMap.Retry = &retryDescr{Attempts: 4, Backoff: 1, MaxBackoff: 5, Timeout: 1}
+
+	// uhura is restarting: three server errors, then OK
+	var calls int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch calls {
+		case 1, 2, 3:
+			http.Error(w, "restarting", http.StatusServiceUnavailable)
+		default:
+			b, _ := json.Marshal(StatusReply{Status: "OK", ReplyCode: RespOK, Timestamp: time.Now().Format(time.RFC822)})
+			fmt.Fprint(w, string(b))
+		}
+	}))
+	defer ts.Close()
+	envMap.UhuraURL = ts.URL + "/"
+
+	var ur StatusReply
+	rc, err := PostStatus(&StatusMsg{State: "INIT", InstName: "MainTestInstance", UID: "prog2", Tstamp: "x"}, &ur)
+	if err != nil || rc != 200 || calls != 4 {
+		t.Errorf("expected success on 4th attempt, got rc=%d err=%v after %d calls", rc, err, calls)
+	}
+
+	// a proxy answers with an error page: retrying won't help
+	calls = 0
+	ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "<html>not found</html>")
+	})
+	_, err = PostStatus(&StatusMsg{State: "INIT", InstName: "MainTestInstance", UID: "prog2", Tstamp: "x"}, &ur)
+	if pe, ok := err.(*PostError); !ok || pe.Transient || calls != 1 {
+		t.Errorf("expected one attempt and a permanent error, got %v after %d calls", err, calls)
+	}
+
+	// uhura never comes back
+	calls = 0
+	ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		http.Error(w, "down", http.StatusBadGateway)
+	})
+	rc, err = PostStatus(&StatusMsg{State: "INIT", InstName: "MainTestInstance", UID: "prog2", Tstamp: "x"}, &ur)
+	pe, ok := err.(*PostError)
+	if !ok {
+		t.Fatalf("expected *PostError, got %T: %v", err, err)
+	}
+	if pe.Attempts != 4 || calls != 4 || !pe.Transient || rc != http.StatusBadGateway {
+		t.Errorf("unexpected result: rc=%d calls=%d err=%+v", rc, calls, pe)
+	}
+
+	// nothing is listening at all
+	ts.Close()
+	_, err = PostStatus(&StatusMsg{State: "INIT", InstName: "MainTestInstance", UID: "prog2", Tstamp: "x"}, &ur)
+	if pe, ok := err.(*PostError); !ok || pe.StatusCode != 0 || pe.Attempts != 4 {
+		t.Errorf("expected connection failure after 4 attempts, got %v", err)
+	}
+}
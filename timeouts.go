@@ -0,0 +1,115 @@
+package main
+
+import "time"
+
+// timeoutDescr holds the optional timeout and poll-interval settings for
+// the states TGO moves through. All values are in seconds. A value of 0
+// means the setting was not supplied and the default is used.
+//
+// The environment descriptor may supply a timeoutDescr for the whole
+// environment and each app may supply its own. Since a state is not
+// complete until every app has made it through, an app's timeout can only
+// extend the time allowed for a state, and an app's poll interval can only
+// shorten the interval between polls. The exception is Term, which is applied
+// to each app individually.
+type timeoutDescr struct {
+	Unknown   int // time allowed to start all apps
+	Init      int // time allowed for all apps to reach INIT
+	Ready     int // time allowed for all apps to reach READY
+	TestNow   int // time allowed for uhura to send the TESTNOW command
+	Test      int // time allowed for all tests to complete
+	Term      int // time allowed for each app to stop before it is killed
+	PollInit  int // time between 'ready' calls while in INIT
+	PollReady int // time between 'ready' calls while in READY
+	PollTest  int // time between 'teststatus' calls while in TEST
+}
+
+// defaultTimeouts are the values used for any setting that is not
+// supplied in the environment descriptor
+var defaultTimeouts = timeoutDescr{
+	Unknown:   30 * 60,
+	Init:      30 * 60,
+	Ready:     15 * 60,
+	TestNow:   30 * 60,
+	Test:      30 * 60,
+	Term:      30,
+	PollInit:  15,
+	PollReady: 15,
+	PollTest:  10,
+}
+
+// timeoutSecs returns the timeout and poll interval values in t for the
+// named state. The state names are those we report to uhura, plus TESTNOW
+// for the time spent waiting on uhura's go-ahead to start testing.
+func (t *timeoutDescr) timeoutSecs(state string) (timeout, poll int) {
+	if t == nil {
+		return 0, 0
+	}
+	switch state {
+	case "UNKNOWN":
+		return t.Unknown, 0
+	case "INIT":
+		return t.Init, t.PollInit
+	case "READY":
+		return t.Ready, t.PollReady
+	case "TESTNOW":
+		return t.TestNow, 0
+	case "TEST":
+		return t.Test, t.PollTest
+	case "TERM":
+		return t.Term, 0
+	}
+	return 0, 0
+}
+
+// stateTimeouts computes the timeout and poll interval for the named state
+// from the environment's settings, the settings of each app in this instance,
+// and the defaults.
+func stateTimeouts(state string) (timeout, poll time.Duration) {
+	t, p := envMap.Timeouts.timeoutSecs(state)
+	dt, dp := defaultTimeouts.timeoutSecs(state)
+	if t <= 0 {
+		t = dt
+	}
+	if p <= 0 {
+		p = dp
+	}
+	if len(envMap.Instances) > envMap.ThisInst {
+		for i := 0; i < len(envMap.Instances[envMap.ThisInst].Apps); i++ {
+			at, ap := envMap.Instances[envMap.ThisInst].Apps[i].Timeouts.timeoutSecs(state)
+			if at > t {
+				t = at
+			}
+			if ap > 0 && ap < p {
+				p = ap
+			}
+		}
+	}
+	return time.Duration(t) * time.Second, time.Duration(p) * time.Second
+}
+
+// stateTimeout returns the time allowed for the named state
+func stateTimeout(state string) time.Duration {
+	t, _ := stateTimeouts(state)
+	return t
+}
+
+// pollInterval returns the time to wait between polls in the named state
+func pollInterval(state string) time.Duration {
+	_, p := stateTimeouts(state)
+	return p
+}
+
+// appTimeout returns the timeout for the named state for a single app. The
+// app's own setting is used if it has one, otherwise the environment's
+// setting or the default.
+func appTimeout(a *appDescr, state string) time.Duration {
+	t, _ := a.Timeouts.timeoutSecs(state)
+	if t <= 0 {
+		t, _ = envMap.Timeouts.timeoutSecs(state)
+	}
+	if t <= 0 {
+		t, _ = defaultTimeouts.timeoutSecs(state)
+	}
+	return time.Duration(t) * time.Second
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//  TLS.
+//
+//  Communication with uhura is plain HTTP unless the environment
+//  descriptor has a TLS section (or tgo is given the -tlscert, -tlskey and
+//  -tlsca flags, which override it):
+//
+//  - With Cert and Key, tgo's command port serves HTTPS.
+//  - With CA, tgo verifies uhura's certificate against that bundle instead
+//    of the system roots. Use an https UhuraURL to talk to uhura over TLS.
+//  - With Mutual, the command port also requires clients to present a
+//    certificate signed by CA. tgo presents Cert to uhura whenever uhura
+//    asks for a client certificate.
+
+// tlsDescr describes how tgo uses TLS
+type tlsDescr struct {
+	Cert   string // PEM file with tgo's certificate chain
+	Key    string // PEM file with its private key
+	CA     string // PEM bundle of the CAs trusted to sign uhura's certificate, and clients' if Mutual
+	Mutual bool   // require clients of the command port to present a certificate
+}
+
+// loadCertPool reads a PEM bundle of CA certificates
+func loadCertPool(file string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// clientTLSConfig returns the TLS settings for requests to uhura, or nil if
+// there are none
+func clientTLSConfig(td *tlsDescr) (*tls.Config, error) {
+	if td == nil {
+		return nil, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if td.CA != "" {
+		pool, err := loadCertPool(td.CA)
+		if err != nil {
+			return nil, fmt.Errorf("TLS CA: %v", err)
+		}
+		cfg.RootCAs = pool
+	}
+	if td.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(td.Cert, td.Key)
+		if err != nil {
+			return nil, fmt.Errorf("TLS certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// serverTLSConfig returns the TLS settings for the command port, or nil if
+// it is plain HTTP
+func serverTLSConfig(td *tlsDescr) (*tls.Config, error) {
+	if td == nil || td.Cert == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(td.Cert, td.Key)
+	if err != nil {
+		return nil, fmt.Errorf("TLS certificate: %v", err)
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}}
+	if td.Mutual {
+		if td.CA == "" {
+			return nil, fmt.Errorf("TLS: Mutual needs a CA to verify clients with")
+		}
+		pool, err := loadCertPool(td.CA)
+		if err != nil {
+			return nil, fmt.Errorf("TLS CA: %v", err)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// uhuraTransports holds a transport for each TLS setup, so that connections
+// to uhura are reused from one request to the next
+var uhuraTransports = struct {
+	sync.Mutex
+	m map[tlsDescr]*http.Transport
+}{m: make(map[tlsDescr]*http.Transport)}
+
+// uhuraClient returns an http.Client for requests to uhura
+func uhuraClient(timeout time.Duration) (*http.Client, error) {
+	if envMap.TLS == nil {
+		return &http.Client{Timeout: timeout}, nil
+	}
+	uhuraTransports.Lock()
+	defer uhuraTransports.Unlock()
+	t, ok := uhuraTransports.m[*envMap.TLS]
+	if !ok {
+		cfg, err := clientTLSConfig(envMap.TLS)
+		if err != nil {
+			return nil, err
+		}
+		t = http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = cfg
+		uhuraTransports.m[*envMap.TLS] = t
+	}
+	return &http.Client{Timeout: timeout, Transport: t}, nil
+}
+
+// tlsFlags are the TLS settings from the command line
+var tlsFlags tlsDescr
+
+// applyTLSFlags overrides the TLS settings in the environment descriptor
+// with any given on the command line
+func applyTLSFlags() {
+	if tlsFlags == (tlsDescr{}) {
+		return
+	}
+	td := tlsDescr{}
+	if envMap.TLS != nil {
+		td = *envMap.TLS
+	}
+	if tlsFlags.Cert != "" {
+		td.Cert, td.Key = tlsFlags.Cert, tlsFlags.Key
+	}
+	if tlsFlags.CA != "" {
+		td.CA = tlsFlags.CA
+	}
+	td.Mutual = td.Mutual || tlsFlags.Mutual
+	envMap.TLS = &td
+}
+
+// commsServer returns the server for tgo's command port at addr
+func commsServer(addr string) (*http.Server, error) {
+	cfg, err := serverTLSConfig(envMap.TLS)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Server{Addr: addr, Handler: newCommsMux(), TLSConfig: cfg}, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPKI is a CA and certificates it has signed, written to a directory
+type testPKI struct {
+	dir    string
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	serial int64
+}
+
+// newTestPKI creates a CA in a temporary directory. Its certificate is ca.pem.
+func newTestPKI(t *testing.T) *testPKI {
+	p := &testPKI{dir: t.TempDir()}
+	p.ca, p.caKey = p.issue(t, "ca", &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "tgo test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+	return p
+}
+
+// issue creates a key and a certificate from the template, signed by the CA
+// (or self-signed if there is no CA yet), and writes them to name.pem and
+// name-key.pem
+func (p *testPKI) issue(t *testing.T, name string, tmpl *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.serial++
+	tmpl.SerialNumber = big.NewInt(p.serial)
+	tmpl.NotBefore, tmpl.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	parent, signer := tmpl, key
+	if p.ca != nil {
+		parent, signer = p.ca, p.caKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	kb, _ := x509.MarshalECPrivateKey(key)
+	write := func(file, typ string, b []byte) {
+		if err := ioutil.WriteFile(filepath.Join(p.dir, file), pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b}), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(name+".pem", "CERTIFICATE", der)
+	write(name+"-key.pem", "EC PRIVATE KEY", kb)
+	return cert, key
+}
+
+// leaf issues a certificate for localhost usable by servers and clients
+func (p *testPKI) leaf(t *testing.T, name string) {
+	p.issue(t, name, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	})
+}
+
+// file returns the path of a file written by the PKI
+func (p *testPKI) file(name string) string {
+	return filepath.Join(p.dir, name)
+}
+
+func TestTLSPostStatus(t *testing.T) {
+	defer supervisedEnv()()
+	pki := newTestPKI(t)
+	pki.leaf(t, "uhura")
+	pki.leaf(t, "tgo")
+	envMap.Retry = &retryDescr{Attempts: 1}
+
+	// uhura requires a client certificate signed by the CA
+	uhura := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SendReply(w, RespOK, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	cert, err := tls.LoadX509KeyPair(pki.file("uhura.pem"), pki.file("uhura-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, _ := loadCertPool(pki.file("ca.pem"))
+	uhura.TLS = &tls.Config{Certificates: []tls.Certificate{cert}, ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert}
+	uhura.StartTLS()
+	defer uhura.Close()
+	envMap.UhuraURL = uhura.URL + "/"
+
+	var r StatusReply
+	envMap.TLS = &tlsDescr{CA: pki.file("ca.pem"), Cert: pki.file("tgo.pem"), Key: pki.file("tgo-key.pem")}
+	if _, err := PostStatus(&StatusMsg{State: "INIT", UID: "tgo0"}, &r); err != nil || r.Status != "tgo" {
+		t.Errorf("mutual TLS: expected uhura to see tgo's certificate, got %v %+v", err, r)
+	}
+
+	envMap.TLS = &tlsDescr{CA: pki.file("ca.pem")}
+	if _, err := PostStatus(&StatusMsg{State: "INIT", UID: "tgo0"}, &r); err == nil {
+		t.Errorf("expected uhura to reject tgo without a client certificate")
+	}
+
+	envMap.TLS = nil
+	if _, err := PostStatus(&StatusMsg{State: "INIT", UID: "tgo0"}, &r); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("expected uhura's certificate not to be trusted without the CA, got %v", err)
+	}
+}
+
+func TestTLSListener(t *testing.T) {
+	defer supervisedEnv()()
+	pki := newTestPKI(t)
+	pki.leaf(t, "tgo")
+	pki.leaf(t, "uhura")
+	envMap.TLS = &tlsDescr{Cert: pki.file("tgo.pem"), Key: pki.file("tgo-key.pem"), CA: pki.file("ca.pem"), Mutual: true}
+
+	srv, err := commsServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeTLS(ln, "", "")
+	defer srv.Close()
+	url := "https://" + ln.Addr().String() + "/v1/status"
+
+	get := func(td *tlsDescr) error {
+		cfg, err := clientTLSConfig(td)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{TLSClientConfig: cfg}}
+		resp, err := c.Get(url)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	if err := get(&tlsDescr{CA: pki.file("ca.pem"), Cert: pki.file("uhura.pem"), Key: pki.file("uhura-key.pem")}); err != nil {
+		t.Errorf("client with a certificate: %v", err)
+	}
+	if err := get(&tlsDescr{CA: pki.file("ca.pem")}); err == nil {
+		t.Errorf("expected a client without a certificate to be rejected")
+	}
+
+	envMap.TLS.CA = ""
+	if _, err := commsServer(":0"); err == nil {
+		t.Errorf("expected Mutual without a CA to be an error")
+	}
+}
+
+func TestApplyTLSFlags(t *testing.T) {
+	defer supervisedEnv()()
+	envMap.TLS = &tlsDescr{Cert: "env.pem", Key: "env-key.pem", CA: "env-ca.pem"}
+	tlsFlags = tlsDescr{CA: "flag-ca.pem"}
+	defer func() { tlsFlags = tlsDescr{} }()
+	applyTLSFlags()
+	if *envMap.TLS != (tlsDescr{Cert: "env.pem", Key: "env-key.pem", CA: "flag-ca.pem"}) {
+		t.Errorf("unexpected TLS settings %+v", *envMap.TLS)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+//  Status transports.
+//
+//  PostStatus hands each attempt to deliver a status message to a
+//  StatusTransport, so the retries, metrics and events work the same
+//  whichever one is used. The environment descriptor's Transport
+//  section picks one:
+//
+//      http   POST to UhuraURL + "status/", the default
+//      file   append each message as a line of JSON to Path, and reply OK.
+//             This runs tgo with no uhura; send TESTNOW with curl.
+//      unix   POST over the Unix-domain socket at Path
+//
+//  Heartbeats, artifacts and HELLO go to UhuraURL over HTTP, so they are
+//  only sent with the http transport. With the others, artifacts are
+//  bundled only if ArtifactURL is set, and protocol 1 is used.
+
+// StatusTransport delivers status messages to uhura
+type StatusTransport interface {
+	// Post makes one attempt to deliver the JSON status message b and
+	// decodes the reply into r. It returns the HTTP status code of the
+	// reply (200 if there is no HTTP), whether a failure is worth
+	// retrying, and any error.
+	Post(ctx context.Context, b []byte, r *StatusReply) (int, bool, error)
+}
+
+// transportDescr selects the StatusTransport
+type transportDescr struct {
+	Type string // http, file or unix. Default http
+	Path string // the spool file, or the socket
+}
+
+// httpTransport posts status messages to a URL
+type httpTransport struct {
+	client *http.Client
+	url    string
+}
+
+// Post implements StatusTransport
+func (t *httpTransport) Post(ctx context.Context, b []byte, r *StatusReply) (int, bool, error) {
+	return postOnce(ctx, t.client, t.url, b, r)
+}
+
+// fileTransport appends status messages to a file, one per line
+type fileTransport struct {
+	path string
+}
+
+// spoolLock keeps lines written by concurrent posts whole
+var spoolLock sync.Mutex
+
+// Post implements StatusTransport. Every message is accepted.
+func (t *fileTransport) Post(ctx context.Context, b []byte, r *StatusReply) (int, bool, error) {
+	spoolLock.Lock()
+	defer spoolLock.Unlock()
+	f, err := os.OpenFile(t.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, false, err
+	}
+	_, err = f.Write(append(b, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	*r = StatusReply{Status: "OK", ReplyCode: RespOK, Timestamp: protoTimestamp()}
+	r.normalize()
+	return http.StatusOK, false, nil
+}
+
+// unixTransport returns a transport that posts status messages over the
+// Unix-domain socket at path
+func unixTransport(path string, timeout time.Duration) *httpTransport {
+	t := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+		DisableKeepAlives: true,
+	}
+	return &httpTransport{client: &http.Client{Timeout: timeout, Transport: t}, url: "http://uhura/status/"}
+}
+
+// uhuraOverHTTP reports whether status messages go to uhura at UhuraURL
+func uhuraOverHTTP() bool {
+	return envMap.Transport == nil || envMap.Transport.Type == "" || envMap.Transport.Type == "http"
+}
+
+// statusTransport returns the configured StatusTransport. timeout limits
+// each attempt.
+func statusTransport(timeout time.Duration) (StatusTransport, error) {
+	td := envMap.Transport
+	if td == nil {
+		td = &transportDescr{}
+	}
+	switch td.Type {
+	case "", "http":
+		client, err := uhuraClient(timeout)
+		if err != nil {
+			return nil, err
+		}
+		return &httpTransport{client: client, url: envMap.UhuraURL + "status/"}, nil
+	case "file":
+		if td.Path == "" {
+			return nil, fmt.Errorf("file transport needs a Path")
+		}
+		return &fileTransport{path: td.Path}, nil
+	case "unix":
+		if td.Path == "" {
+			return nil, fmt.Errorf("unix transport needs a Path")
+		}
+		return unixTransport(td.Path, timeout), nil
+	}
+	return nil, fmt.Errorf("unknown transport %q", td.Type)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestFileTransport(t *testing.T) {
+	defer supervisedEnv()()
+	spool := filepath.Join(t.TempDir(), "status.jsonl")
+	envMap.UhuraURL = "http://localhost:1/" // nothing there
+	envMap.Transport = &transportDescr{Type: "file", Path: spool}
+
+	var wg sync.WaitGroup
+	for _, s := range []string{"INIT", "READY", "TEST"} {
+		wg.Add(1)
+		go func(s string) {
+			defer wg.Done()
+			var r StatusReply
+			if rc, err := PostStatus(&StatusMsg{State: s, UID: "tgo0"}, &r); err != nil || rc != http.StatusOK || r.ReplyCode != RespOK {
+				t.Errorf("%s: %d %v %+v", s, rc, err, r)
+			}
+		}(s)
+	}
+	wg.Wait()
+	PostFinalStatus(0, "BLOCKED", "spooled")
+
+	f, err := os.Open(spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	states := map[string]bool{}
+	var last StatusMsg
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if err := json.Unmarshal(sc.Bytes(), &last); err != nil {
+			t.Fatalf("bad line %q: %v", sc.Text(), err)
+		}
+		states[last.State] = true
+	}
+	if len(states) != 4 || last.State != "BLOCKED" || last.Reason != "spooled" {
+		t.Errorf("unexpected spool: states %v, last %+v", states, last)
+	}
+}
+
+func TestNoUhuraWithFileTransport(t *testing.T) {
+	app := scriptApp(t, "svc", "echo ok\n")
+	app.Artifacts = []string{"*.log"}
+	defer supervisedEnv(app)()
+	defer setProtocol(protoV1, nil)
+	ioutil.WriteFile(filepath.Join(appDir(&envMap.Instances[0].Apps[1]), "svc.log"), []byte("started"), 0644)
+	envMap.Report = filepath.Join(t.TempDir(), "none.xml")
+	var hits []string
+	uhura := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits = append(hits, r.URL.Path)
+	}))
+	defer uhura.Close()
+	envMap.UhuraURL = uhura.URL + "/"
+	envMap.Transport = &transportDescr{Type: "file", Path: filepath.Join(t.TempDir(), "status.jsonl")}
+	envMap.Protocol = protoV2
+
+	hello(context.Background())
+	uploadArtifacts("DONE")
+	if len(hits) != 0 || protoVersion() != protoV1 {
+		t.Errorf("expected nothing sent to uhura and protocol 1, got %v and %d", hits, protoVersion())
+	}
+
+	// an ArtifactURL still gets the bundle
+	stub := t.TempDir()
+	envMap.ArtifactURL = "file://" + stub
+	uploadArtifacts("DONE")
+	if bundles, _ := filepath.Glob(filepath.Join(stub, "*.tar.gz")); len(bundles) != 1 || len(hits) != 0 {
+		t.Errorf("expected a bundle in %s, got %v (uhura saw %v)", stub, bundles, hits)
+	}
+}
+
+func TestUnixTransport(t *testing.T) {
+	defer supervisedEnv()()
+	sock := filepath.Join(t.TempDir(), "uhura.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skipf("no unix sockets: %v", err)
+	}
+	var msgs []StatusMsg
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var sm StatusMsg
+		json.NewDecoder(r.Body).Decode(&sm)
+		msgs = append(msgs, sm)
+		SendReply(w, RespOK, r.URL.Path)
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+	envMap.Transport = &transportDescr{Type: "unix", Path: sock}
+
+	var r StatusReply
+	if _, err := PostStatus(&StatusMsg{State: "INIT", UID: "tgo0"}, &r); err != nil || r.Status != "/status/" {
+		t.Errorf("unexpected reply %v %+v", err, r)
+	}
+	if len(msgs) != 1 || msgs[0].State != "INIT" {
+		t.Errorf("unexpected messages %+v", msgs)
+	}
+}
+
+func TestBadTransport(t *testing.T) {
+	defer supervisedEnv()()
+	for _, td := range []transportDescr{{Type: "pigeon"}, {Type: "file"}, {Type: "unix"}} {
+		envMap.Transport = &td
+		var r StatusReply
+		if _, err := PostStatus(&StatusMsg{State: "INIT"}, &r); err == nil {
+			t.Errorf("%+v: expected an error", td)
+		} else if pe, ok := err.(*PostError); !ok || pe.Attempts != 0 {
+			t.Errorf("%+v: expected no attempts, got %v", td, err)
+		}
+	}
+}